@@ -0,0 +1,327 @@
+package main
+
+import (
+	"cosmetics/internal"
+	"cosmetics/routes"
+	"cosmetics/utils"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/google/uuid"
+)
+
+const usage = `Usage: cosmetics [command] [flags] [arguments]
+
+Commands:
+  serve                          Run the server, the default without a command
+  migrate up                     Apply all pending migrations
+  migrate down N                 Roll back the last N migrations
+  migrate goto V                 Migrate up or down to version V
+  migrate force V                Mark version V as applied without running it, to recover from a dirty migration
+  migrate status                 Show the version of the database and of this build
+  grant UUID COSMETIC            Give a cosmetic to a player
+  revoke UUID COSMETIC           Take a cosmetic from a player
+  cosmetic put ID FILE           Create or update a cosmetic from a JSON file, - reads standard input
+  export [FILE]                  Write an archive of every cosmetic, player and grant to a file or standard output
+  import [--mode merge|replace] [--dry-run] FILE
+                                 Apply an archive and report the changes, - reads standard input
+  token create [FILE]            Generate an api token, written to FILE with restricted permissions if given
+
+Every command but token create takes the config flags, run a command with -h to list them.
+Flags have to come before the arguments.
+`
+
+// errUsage marks errors caused by wrong arguments, the usage is printed along with them
+var errUsage = errors.New("invalid arguments")
+
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "serve":
+		serve(args)
+		return
+	case "migrate":
+		err = migrateCommand(args)
+	case "grant":
+		err = grantCommand("grant", args, routes.GrantCosmetic)
+	case "revoke":
+		err = grantCommand("revoke", args, routes.RevokeCosmetic)
+	case "cosmetic":
+		err = cosmeticCommand(args)
+	case "export":
+		err = exportCommand(args)
+	case "import":
+		err = importCommand(args)
+	case "token":
+		err = tokenCommand(args)
+	case "help", "-h", "--help":
+		_, _ = fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		err = fmt.Errorf("%w: unknown command %q", errUsage, name)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if errors.Is(err, errUsage) {
+			_, _ = fmt.Fprintf(os.Stderr, "\n%s", usage)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// commandConfig loads the config for a command with the given loader and returns the arguments left after the flags.
+// Logs go to standard error, standard output is left to the command.
+func commandConfig(load func(*flag.FlagSet, []string) (internal.Config, error), flags *flag.FlagSet, args []string) (internal.Config, []string, error) {
+	conf, err := load(flags, args)
+	if err != nil {
+		return conf, nil, err
+	}
+	if conf.Storage != internal.StoragePostgres {
+		return conf, nil, fmt.Errorf("commands need storage %s, storage %s only lives inside a running server", internal.StoragePostgres, conf.Storage)
+	}
+	level, _ := conf.Log.SlogLevel()
+	utils.SetupLogging(os.Stderr, conf.Log.Format, level)
+	conf.LogWarnings()
+	return conf, flags.Args(), nil
+}
+
+// commandContext loads the whole config for a command and connects to the store.
+// Unlike the server it doesn't wait for the database or migrate it, a command fails right away instead.
+func commandContext(flags *flag.FlagSet, args []string) (internal.RouteContext, []string, error) {
+	conf, args, err := commandConfig(internal.LoadConfig, flags, args)
+	if err != nil {
+		return internal.RouteContext{}, nil, err
+	}
+	ctx, err := internal.NewRouteContext(conf)
+	if err != nil {
+		return ctx, nil, err
+	}
+	// Lines logged for the changes of a command name it as the actor, like the ones of api requests name the token
+	info := &utils.RequestInfo{Id: utils.NewRequestId()}
+	info.SetActor("cli")
+	ctx.Context = utils.WithRequestInfo(ctx.Context, info)
+	return ctx, args, nil
+}
+
+func commandFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+func closeContext(ctx internal.RouteContext) {
+	ctx.Store.Close()
+}
+
+func parseVersion(value string) (uint, error) {
+	version, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid version %q", errUsage, value)
+	}
+	return uint(version), nil
+}
+
+// migrateCommand only needs the database settings, so the schema can be prepared before the rest of the config exists
+func migrateCommand(args []string) error {
+	conf, args, err := commandConfig(internal.LoadDatabaseConfig, commandFlags("migrate"), args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: migrate needs an action", errUsage)
+	}
+	action, args := args[0], args[1:]
+	var target uint
+	switch action {
+	case "up", "status":
+		if len(args) != 0 {
+			return fmt.Errorf("%w: migrate %s takes no arguments", errUsage, action)
+		}
+	case "down", "goto", "force":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: migrate %s takes one argument", errUsage, action)
+		}
+		target, err = parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		if action == "down" && target == 0 {
+			return fmt.Errorf("%w: migrate down needs at least one step", errUsage)
+		}
+	default:
+		return fmt.Errorf("%w: unknown migrate action %q", errUsage, action)
+	}
+
+	m, err := internal.NewMigrate(conf.PostgresUri)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer m.Close()
+	switch action {
+	case "up":
+		err = m.Up()
+	case "down":
+		err = m.Steps(-int(target))
+	case "goto":
+		err = m.Migrate(target)
+	case "force":
+		err = m.Force(int(target))
+	}
+	if errors.Is(err, migrate.ErrNoChange) {
+		_, _ = fmt.Fprintln(os.Stdout, "No change")
+	} else if err != nil {
+		return err
+	}
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		version, err = 0, nil
+	}
+	if err != nil {
+		return err
+	}
+	latest, err := internal.LatestMigration()
+	if err != nil {
+		return err
+	}
+	status := fmt.Sprintf("Database is at version %d, this build goes up to %d", version, latest)
+	if dirty {
+		status += ", the migration is dirty, fix the database and force a version"
+	}
+	_, _ = fmt.Fprintln(os.Stdout, status)
+	return nil
+}
+
+func grantCommand(name string, args []string, write func(ctx internal.RouteContext, player string, cosmetic string) error) error {
+	ctx, args, err := commandContext(commandFlags(name), args)
+	if err != nil {
+		return err
+	}
+	defer closeContext(ctx)
+	if len(args) != 2 {
+		return fmt.Errorf("%w: expected a player uuid and a cosmetic id", errUsage)
+	}
+	player, err := uuid.Parse(args[0])
+	if err != nil {
+		return fmt.Errorf("%w: invalid player uuid %q", errUsage, args[0])
+	}
+	return write(ctx, player.String(), args[1])
+}
+
+// openInput opens a file, - stands for standard input
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+func cosmeticCommand(args []string) error {
+	if len(args) == 0 || args[0] != "put" {
+		return fmt.Errorf("%w: expected cosmetic put", errUsage)
+	}
+	ctx, args, err := commandContext(commandFlags("cosmetic put"), args[1:])
+	if err != nil {
+		return err
+	}
+	defer closeContext(ctx)
+	if len(args) != 2 {
+		return fmt.Errorf("%w: expected a cosmetic id and a file", errUsage)
+	}
+	file, err := openInput(args[1])
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+	return routes.PutCosmetic(ctx, args[0], file)
+}
+
+func exportCommand(args []string) error {
+	ctx, args, err := commandContext(commandFlags("export"), args)
+	if err != nil {
+		return err
+	}
+	defer closeContext(ctx)
+	if len(args) > 1 {
+		return fmt.Errorf("%w: expected at most one file", errUsage)
+	}
+	archive, err := routes.BuildArchive(ctx)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return archive.Write(os.Stdout)
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	err = archive.Write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func importCommand(args []string) error {
+	flags := commandFlags("import")
+	mode := flags.String("mode", routes.ImportMerge, "Either merge, keeping everything not in the archive, or replace, deleting it")
+	dryRun := flags.Bool("dry-run", false, "Only report what the import would change")
+	ctx, args, err := commandContext(flags, args)
+	if err != nil {
+		return err
+	}
+	defer closeContext(ctx)
+	if len(args) != 1 {
+		return fmt.Errorf("%w: expected a file", errUsage)
+	}
+	file, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	report, err := routes.ImportArchive(ctx, file, *mode, *dryRun)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// tokenCommand generates a token to put into the config, running servers reading it through COSMETICS_API_TOKEN_FILE pick up a new one by themselves
+func tokenCommand(args []string) error {
+	if len(args) == 0 || args[0] != "create" || len(args) > 2 {
+		return fmt.Errorf("%w: expected token create [FILE]", errUsage)
+	}
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	if len(args) == 1 {
+		_, _ = fmt.Fprintln(os.Stdout, token)
+		return nil
+	}
+	// Replacing the file at once keeps a watching server from reading half a token
+	temporary := args[1] + ".tmp"
+	err := os.WriteFile(temporary, []byte(token+"\n"), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, args[1])
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// commandEnv gives the commands a database that is never reached, as they fail before connecting
+func commandEnv(t *testing.T) {
+	t.Setenv("COSMETICS_POSTGRES_URI", "postgres://cosmetics@127.0.0.1:1/cosmetics")
+	t.Setenv("COSMETICS_LOG_LEVEL", "error")
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		value   string
+		version uint
+		valid   bool
+	}{
+		{"3", 3, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"latest", 0, false},
+	}
+	for _, test := range tests {
+		version, err := parseVersion(test.value)
+		if (err == nil) != test.valid || version != test.version {
+			t.Errorf("%q: expected %d valid %v, got %d %v", test.value, test.version, test.valid, version, err)
+		}
+		if err != nil && !errors.Is(err, errUsage) {
+			t.Errorf("%q: expected a usage error, got %v", test.value, err)
+		}
+	}
+}
+
+// migrate only needs the database settings, the usage errors show the config was accepted without an api token
+func TestMigrateCommandArguments(t *testing.T) {
+	commandEnv(t)
+	tests := []struct {
+		args  []string
+		error string
+	}{
+		{nil, "migrate needs an action"},
+		{[]string{"sideways"}, `unknown migrate action "sideways"`},
+		{[]string{"up", "1"}, "migrate up takes no arguments"},
+		{[]string{"down"}, "migrate down takes one argument"},
+		{[]string{"down", "0"}, "migrate down needs at least one step"},
+		{[]string{"goto", "latest"}, `invalid version "latest"`},
+	}
+	for _, test := range tests {
+		err := migrateCommand(test.args)
+		if !errors.Is(err, errUsage) || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%v: expected %q, got %v", test.args, test.error, err)
+		}
+	}
+}
+
+func TestCommandConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		run   func([]string) error
+		env   map[string]string
+		error string
+	}{
+		{"migrate without database", migrateCommand, map[string]string{"COSMETICS_POSTGRES_URI": ""}, "postgres_uri is required"},
+		{"migrate with memory storage", migrateCommand, map[string]string{"COSMETICS_STORAGE": "memory"}, "commands need storage postgres"},
+		{"grant without api token", func(args []string) error {
+			return grantCommand("grant", args, nil)
+		}, nil, "api_token is required"},
+		{"cosmetic without put", cosmeticCommand, nil, "expected cosmetic put"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commandEnv(t)
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			err := test.run(nil)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("expected %q, got %v", test.error, err)
+			}
+		})
+	}
+}
+
+func TestTokenCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := tokenCommand([]string{"create", file}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the token to be readable by the owner only, got %v", info.Mode())
+	}
+	data, _ := os.ReadFile(file)
+	token, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(string(data), "\n"))
+	if err != nil || len(token) != 32 {
+		t.Errorf("expected 32 random bytes, got %q", data)
+	}
+
+	for _, args := range [][]string{nil, {"delete"}, {"create", file, "extra"}} {
+		if err := tokenCommand(args); !errors.Is(err, errUsage) {
+			t.Errorf("%v: expected a usage error, got %v", args, err)
+		}
+	}
+}
@@ -1,5 +1,5 @@
 package internal
 
-func IsAuthenticated(data string) bool {
-	return config.ApiToken == data
+func (conf *Config) IsAuthenticated(data string) bool {
+	return conf.ApiToken == data
 }
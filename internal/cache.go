@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type cacheSnapshot[T any] struct {
+	value      T
+	created    time.Time
+	generation uint64
+}
+
+// Cache holds a single lazily built value that can be read without locking.
+// Concurrent misses share one rebuild and Invalidate makes every snapshot built before it stale immediately.
+type Cache[T any] struct {
+	snapshot   atomic.Pointer[cacheSnapshot[T]]
+	generation atomic.Uint64
+	group      singleflight.Group
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+func NewCache[T any]() *Cache[T] {
+	return &Cache[T]{}
+}
+
+func (cache *Cache[T]) fresh(ttl time.Duration) *cacheSnapshot[T] {
+	snapshot := cache.snapshot.Load()
+	if snapshot == nil || snapshot.generation != cache.generation.Load() || time.Since(snapshot.created) >= ttl {
+		return nil
+	}
+	return snapshot
+}
+
+// Get returns the cached value and the time it was built, rebuilding it if it is older than ttl or was invalidated.
+func (cache *Cache[T]) Get(ttl time.Duration, build func() (T, error)) (T, time.Time, error) {
+	if snapshot := cache.fresh(ttl); snapshot != nil {
+		cache.hits.Add(1)
+		return snapshot.value, snapshot.created, nil
+	}
+	cache.misses.Add(1)
+
+	generation := cache.generation.Load()
+	result, err, _ := cache.group.Do(strconv.FormatUint(generation, 10), func() (interface{}, error) {
+		if snapshot := cache.fresh(ttl); snapshot != nil {
+			return snapshot, nil
+		}
+
+		created := time.Now()
+		value, err := build()
+		if err != nil {
+			return nil, err
+		}
+		snapshot := &cacheSnapshot[T]{value, created, generation}
+		cache.store(snapshot)
+		return snapshot, nil
+	})
+	if err != nil {
+		var empty T
+		return empty, time.Time{}, err
+	}
+
+	snapshot := result.(*cacheSnapshot[T])
+	return snapshot.value, snapshot.created, nil
+}
+
+// store replaces the current snapshot unless a rebuild of a newer generation already finished.
+func (cache *Cache[T]) store(snapshot *cacheSnapshot[T]) {
+	for {
+		current := cache.snapshot.Load()
+		if current != nil && current.generation > snapshot.generation {
+			return
+		}
+		if cache.snapshot.CompareAndSwap(current, snapshot) {
+			return
+		}
+	}
+}
+
+// Last returns the most recently built value, no matter if it's still fresh
+func (cache *Cache[T]) Last() (T, time.Time, bool) {
+	snapshot := cache.snapshot.Load()
+	if snapshot == nil {
+		var empty T
+		return empty, time.Time{}, false
+	}
+	return snapshot.value, snapshot.created, true
+}
+
+// Seed sets a value that was built elsewhere if nothing was built yet
+func (cache *Cache[T]) Seed(value T, created time.Time) {
+	cache.snapshot.CompareAndSwap(nil, &cacheSnapshot[T]{value, created, cache.generation.Load()})
+}
+
+func (cache *Cache[T]) Invalidate() {
+	cache.generation.Add(1)
+}
+
+func (cache *Cache[T]) Stats() CacheStats {
+	return CacheStats{
+		Hits:   cache.hits.Load(),
+		Misses: cache.misses.Load(),
+	}
+}
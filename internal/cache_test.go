@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheGet(t *testing.T) {
+	cache := NewCache[int]()
+	builds := 0
+	build := func() (int, error) {
+		builds++
+		return builds, nil
+	}
+
+	tests := []struct {
+		name       string
+		before     func()
+		ttl        time.Duration
+		want       int
+		wantBuilds int
+	}{
+		{"first read builds", nil, time.Hour, 1, 1},
+		{"fresh value is reused", nil, time.Hour, 1, 1},
+		{"expired value is rebuilt", nil, 0, 2, 2},
+		{"invalidated value is rebuilt", cache.Invalidate, time.Hour, 3, 3},
+		{"rebuilt value is reused", nil, time.Hour, 3, 3},
+	}
+	for _, test := range tests {
+		if test.before != nil {
+			test.before()
+		}
+		value, created, err := cache.Get(test.ttl, build)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if value != test.want || builds != test.wantBuilds {
+			t.Errorf("%s: expected value %d after %d builds, got %d after %d", test.name, test.want, test.wantBuilds, value, builds)
+		}
+		if created.IsZero() {
+			t.Errorf("%s: expected the build time", test.name)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 3 {
+		t.Errorf("expected 2 hits and 3 misses, got %+v", stats)
+	}
+}
+
+func TestCacheGetError(t *testing.T) {
+	cache := NewCache[string]()
+	failure := errors.New("database unavailable")
+	if _, _, err := cache.Get(time.Hour, func() (string, error) {
+		return "", failure
+	}); !errors.Is(err, failure) {
+		t.Fatalf("expected the build error, got %v", err)
+	}
+	if _, _, ok := cache.Last(); ok {
+		t.Error("a failed build must not be cached")
+	}
+
+	value, _, err := cache.Get(time.Hour, func() (string, error) {
+		return "entries", nil
+	})
+	if err != nil || value != "entries" {
+		t.Errorf("expected the next read to build again, got %q, %v", value, err)
+	}
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	cache := NewCache[int]()
+	var builds atomic.Int32
+	release := make(chan struct{})
+
+	var wait sync.WaitGroup
+	for range 10 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, _, _ = cache.Get(time.Hour, func() (int, error) {
+				builds.Add(1)
+				<-release
+				return 1, nil
+			})
+		}()
+	}
+	// Give every reader the chance to miss before the build finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wait.Wait()
+
+	if builds.Load() != 1 {
+		t.Errorf("expected concurrent misses to share one build, got %d", builds.Load())
+	}
+}
+
+func TestCacheLastAndSeed(t *testing.T) {
+	cache := NewCache[string]()
+	created := time.Now().Add(-time.Minute)
+	cache.Seed("stale", created)
+
+	value, seeded, ok := cache.Last()
+	if !ok || value != "stale" || !seeded.Equal(created) {
+		t.Fatalf("expected the seeded value, got %q, %v", value, ok)
+	}
+
+	cache.Invalidate()
+	if value, _, _ := cache.Get(time.Hour, func() (string, error) {
+		return "fresh", nil
+	}); value != "fresh" {
+		t.Errorf("expected a seeded value to be replaced once invalidated, got %q", value)
+	}
+	cache.Seed("stale", created)
+	if value, _, _ := cache.Last(); value != "fresh" {
+		t.Errorf("seeding must not replace a built value, got %q", value)
+	}
+}
@@ -1,30 +1,318 @@
 package internal
 
 import (
-	"encoding/json"
-	"os"
+	"cosmetics/utils"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Config is loaded by LoadConfig, settings marked as secret are redacted whenever the config is printed
+// and only settings marked as live can change when the config is reloaded.
+// Numbers can't be negative or lower than their min tag. Intervals and timeouts have a min of 1, as 0 would disable them.
 type Config struct {
-	PostgresUri string `json:"postgres_uri"`
-	ApiToken    string `json:"api_token"`
-	DevMode     bool   `json:"dev_mode"`
+	PostgresUri string `json:"postgres_uri" secret:"true"`
+	ApiToken    string `json:"api_token" secret:"true" live:"true"`
 	Port        string `json:"port"`
+	// Either postgres or memory, which needs no database but keeps everything in this process only
+	Storage string `json:"storage"`
+	// Keeps the whole dataset in memory and serves the public reads from it, updated through the change notifications
+	InMemory  bool            `json:"in_memory"`
+	Cache     CacheConfig     `json:"cache"`
+	Snapshots SnapshotConfig  `json:"snapshots"`
+	Events    EventsConfig    `json:"events"`
+	Startup   StartupConfig   `json:"startup"`
+	Replica   ReplicaConfig   `json:"replica"`
+	Server    ServerConfig    `json:"server"`
+	Log       LogConfig       `json:"log"`
+	Admin     AdminConfig     `json:"admin"`
+	Readiness ReadinessConfig `json:"readiness"`
+	Tracing   TracingConfig   `json:"tracing"`
+	// The files the config was read from, they are watched for changes
+	files []string
+	// Logged by LogWarnings, loading the config happens before logging is set up
+	warnings []utils.LogData
+}
+
+// CacheConfig holds the cache durations in seconds
+type CacheConfig struct {
+	// How long the server reuses a built entries payload
+	Ttl int `json:"ttl" live:"true"`
+	// How long clients are allowed to keep the entries payload
+	MaxAge int `json:"max_age" live:"true"`
+	// Optional file keeping the last built entries, so they can be served while the database is unavailable even after a restart
+	StaleFile string `json:"stale_file"`
+}
+
+func (conf CacheConfig) TtlDuration() time.Duration {
+	return time.Duration(conf.Ttl) * time.Second
 }
 
-func NewConfig() Config {
-	env := os.Getenv("CONFIG")
+// EventsConfig limits the change log the event streams resume from
+type EventsConfig struct {
+	// How many of the latest changes are kept, older ones are pruned
+	Retention int `json:"retention" live:"true" min:"1"`
+	// How many changes a resuming stream is sent at most, a client that missed more has to resync instead
+	MaxReplay int `json:"max_replay" live:"true" min:"1"`
+}
+
+// SnapshotConfig controls publishing signed copies of the entries for mirrors, it's disabled without a directory
+type SnapshotConfig struct {
+	Directory string `json:"directory"`
+	// Seconds between two published snapshots
+	Interval int `json:"interval" min:"1"`
+	// Base64 encoded ed25519 seed
+	SigningKey string `json:"signing_key" secret:"true"`
+}
+
+func (conf SnapshotConfig) Enabled() bool {
+	return conf.Directory != ""
+}
 
-	if env == "" {
-		panic("CONFIG environment variable not set")
+func (conf SnapshotConfig) IntervalDuration() time.Duration {
+	return time.Duration(conf.Interval) * time.Second
+}
+
+func (conf SnapshotConfig) PrivateKey() (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(conf.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
 	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key: expected %d bytes but got %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReplicaConfig sets up a read replica for the public endpoints, it's disabled without an uri
+type ReplicaConfig struct {
+	Uri string `json:"uri" secret:"true"`
+	// Seconds the replica may lag behind before reads go back to the primary, reads also stay on the primary
+	// for that long after a write, so it can't be 0
+	MaxLag int `json:"max_lag" min:"1"`
+	// Seconds between two lag checks
+	CheckInterval int `json:"check_interval" min:"1"`
+}
+
+func (conf ReplicaConfig) MaxLagDuration() time.Duration {
+	return time.Duration(conf.MaxLag) * time.Second
+}
+
+func (conf ReplicaConfig) CheckIntervalDuration() time.Duration {
+	return time.Duration(conf.CheckInterval) * time.Second
+}
+
+type StartupConfig struct {
+	// Seconds to wait for the database before giving up
+	ConnectTimeout int `json:"connect_timeout" min:"1"`
+}
+
+func (conf StartupConfig) ConnectTimeoutDuration() time.Duration {
+	return time.Duration(conf.ConnectTimeout) * time.Second
+}
+
+// ServerConfig holds the http server timeouts in seconds
+type ServerConfig struct {
+	ReadHeaderTimeout int `json:"read_header_timeout" min:"1"`
+	ReadTimeout       int `json:"read_timeout" min:"1"`
+	// Event streams and live connections set their own deadlines per write
+	WriteTimeout int `json:"write_timeout" min:"1"`
+	IdleTimeout  int `json:"idle_timeout" min:"1"`
+	// How long the health keeps failing before shutdown starts, so load balancers stop sending new requests first
+	DrainDelay int `json:"drain_delay"`
+	// How long in-flight requests get to finish once shutdown started
+	ShutdownTimeout int `json:"shutdown_timeout" min:"1"`
+}
+
+func (conf ServerConfig) ReadHeaderTimeoutDuration() time.Duration {
+	return time.Duration(conf.ReadHeaderTimeout) * time.Second
+}
+
+func (conf ServerConfig) ReadTimeoutDuration() time.Duration {
+	return time.Duration(conf.ReadTimeout) * time.Second
+}
+
+func (conf ServerConfig) WriteTimeoutDuration() time.Duration {
+	return time.Duration(conf.WriteTimeout) * time.Second
+}
+
+func (conf ServerConfig) IdleTimeoutDuration() time.Duration {
+	return time.Duration(conf.IdleTimeout) * time.Second
+}
+
+func (conf ServerConfig) DrainDelayDuration() time.Duration {
+	return time.Duration(conf.DrainDelay) * time.Second
+}
 
-	var config Config
-	err := json.Unmarshal([]byte(env), &config)
+func (conf ServerConfig) ShutdownTimeoutDuration() time.Duration {
+	return time.Duration(conf.ShutdownTimeout) * time.Second
+}
+
+type TracingConfig struct {
+	// One of none, stdout or otlp. stdout prints the spans to standard error, as standard output carries the logs.
+	Exporter string `json:"exporter"`
+	// Url of the OTLP/HTTP collector, without it the standard OTEL_EXPORTER_OTLP_* environment variables are used
+	Endpoint    string  `json:"endpoint"`
+	ServiceName string  `json:"service_name"`
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+func (conf TracingConfig) validate() error {
+	switch conf.Exporter {
+	case TracingDisabled, TracingStdout, TracingOtlp:
+	default:
+		return fmt.Errorf("invalid tracing exporter %q, expected %s, %s or %s", conf.Exporter, TracingDisabled, TracingStdout, TracingOtlp)
+	}
+	if conf.SampleRatio < 0 || conf.SampleRatio > 1 {
+		return fmt.Errorf("invalid tracing sample ratio %v, expected a value between 0 and 1", conf.SampleRatio)
+	}
+	return nil
+}
+
+type ReadinessConfig struct {
+	// Milliseconds a database ping may take before the instance reports itself as not ready
+	MaxPingLatency int `json:"max_ping_latency" min:"1"`
+}
+
+func (conf ReadinessConfig) MaxPingLatencyDuration() time.Duration {
+	return time.Duration(conf.MaxPingLatency) * time.Millisecond
+}
+
+// AdminConfig sets up a separate listener for operational endpoints, so they don't have to be exposed publicly.
+// It serves /metrics, /healthz and /readyz, without an address /metrics is served on the main port and requires the api token.
+type AdminConfig struct {
+	Address string `json:"address"`
+}
+
+func (conf AdminConfig) Enabled() bool {
+	return conf.Address != ""
+}
+
+type LogConfig struct {
+	// Either json or text
+	Format string `json:"format"`
+	// One of debug, info, warn or error
+	Level string `json:"level" live:"true"`
+}
+
+func (conf LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(conf.Level))
 	if err != nil {
-		panic("Failed to parse config: " + err.Error())
+		return level, fmt.Errorf("invalid log level %q", conf.Level)
 	}
-	return config
+	return level, nil
 }
 
-var config = NewConfig()
+func (conf LogConfig) validate() error {
+	if conf.Format != utils.LogFormatJson && conf.Format != utils.LogFormatText {
+		return fmt.Errorf("invalid log format %q, expected %s or %s", conf.Format, utils.LogFormatJson, utils.LogFormatText)
+	}
+	_, err := conf.SlogLevel()
+	return err
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:    "8871",
+		Storage: StoragePostgres,
+		Cache: CacheConfig{
+			Ttl:    5,
+			MaxAge: 300,
+		},
+		Snapshots: SnapshotConfig{
+			Interval: 60,
+		},
+		Events: EventsConfig{
+			Retention: 100000,
+			MaxReplay: 1000,
+		},
+		Startup: StartupConfig{
+			ConnectTimeout: 120,
+		},
+		Replica: ReplicaConfig{
+			MaxLag:        10,
+			CheckInterval: 5,
+		},
+		Log: LogConfig{
+			Format: utils.LogFormatJson,
+			Level:  "info",
+		},
+		Readiness: ReadinessConfig{
+			MaxPingLatency: 500,
+		},
+		Tracing: TracingConfig{
+			Exporter:    TracingDisabled,
+			ServiceName: "cosmetics",
+			SampleRatio: 1,
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5,
+			ReadTimeout:       15,
+			WriteTimeout:      30,
+			IdleTimeout:       120,
+			DrainDelay:        5,
+			ShutdownTimeout:   25,
+		},
+	}
+}
+
+// Validate reports every invalid setting at once, so a broken deployment doesn't have to be fixed one restart at a time
+func (conf Config) Validate() error {
+	errs := conf.validateStorage()
+	if conf.ApiToken == "" {
+		errs = append(errs, missingSetting("api_token"))
+	}
+	if port, err := strconv.Atoi(conf.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %q, expected a number between 1 and 65535", conf.Port))
+	}
+	if conf.Replica.Uri != "" {
+		if _, err := pgxpool.ParseConfig(conf.Replica.Uri); err != nil {
+			errs = append(errs, fmt.Errorf("invalid replica.uri: %w", err))
+		}
+	}
+	// The key is served on its own as well, so it's checked even if no snapshots are written
+	if conf.Snapshots.Enabled() || conf.Snapshots.SigningKey != "" {
+		if _, err := conf.Snapshots.PrivateKey(); err != nil {
+			errs = append(errs, fmt.Errorf("snapshots.signing_key: %w", err))
+		}
+	}
+	errs = append(errs, conf.Log.validate(), conf.Tracing.validate())
+	for _, setting := range settingsOf(&conf) {
+		if setting.value.Kind() == reflect.Int && setting.value.Int() < setting.min {
+			errs = append(errs, fmt.Errorf("invalid %s %d, expected a value of at least %d", setting.name, setting.value.Int(), setting.min))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateDatabase only checks the settings needed to reach the database and log, for commands like migrate that serve nothing
+func (conf Config) ValidateDatabase() error {
+	return errors.Join(append(conf.validateStorage(), conf.Log.validate())...)
+}
+
+func (conf Config) validateStorage() []error {
+	var errs []error
+	switch conf.Storage {
+	case StoragePostgres:
+	case StorageMemory:
+		if conf.Replica.Uri != "" {
+			errs = append(errs, fmt.Errorf("replica.uri needs storage %s", StoragePostgres))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid storage %q, expected %s or %s", conf.Storage, StoragePostgres, StorageMemory))
+	}
+	if conf.PostgresUri == "" && conf.Storage == StoragePostgres {
+		errs = append(errs, missingSetting("postgres_uri"))
+	} else if _, err := pgxpool.ParseConfig(conf.PostgresUri); err != nil {
+		errs = append(errs, fmt.Errorf("invalid postgres_uri: %w", err))
+	}
+	return errs
+}
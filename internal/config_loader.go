@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"bytes"
+	"cosmetics/utils"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the environment variables overriding single settings, like COSMETICS_CACHE_TTL for cache.ttl
+const envPrefix = "COSMETICS_"
+
+const redactedSecret = "[redacted]"
+
+// setting is a single leaf of the config, named by the json keys leading to it
+type setting struct {
+	name   string
+	secret bool
+	live   bool
+	// Lowest value allowed for numbers, from the min tag
+	min   int64
+	value reflect.Value
+}
+
+func (setting setting) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting.name, ".", "_"))
+}
+
+func (setting setting) set(raw string) error {
+	switch setting.value.Kind() {
+	case reflect.String:
+		setting.value.SetString(raw)
+	case reflect.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, expected true or false", setting.name, raw)
+		}
+		setting.value.SetBool(value)
+	case reflect.Int:
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, expected a whole number", setting.name, raw)
+		}
+		setting.value.SetInt(int64(value))
+	case reflect.Float64:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, expected a number", setting.name, raw)
+		}
+		setting.value.SetFloat(value)
+	default:
+		return fmt.Errorf("%s can't be set from text", setting.name)
+	}
+	return nil
+}
+
+// settingsOf lists every setting of the config, the values can be set through the returned settings
+func settingsOf(config *Config) []setting {
+	return appendSettings(nil, "", reflect.ValueOf(config).Elem())
+}
+
+func appendSettings(settings []setting, prefix string, value reflect.Value) []setting {
+	for i := range value.NumField() {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			settings = appendSettings(settings, prefix+name+".", value.Field(i))
+			continue
+		}
+		min, _ := strconv.ParseInt(field.Tag.Get("min"), 10, 64)
+		settings = append(settings, setting{
+			name:   prefix + name,
+			secret: field.Tag.Get("secret") == "true",
+			live:   field.Tag.Get("live") == "true",
+			min:    min,
+			value:  value.Field(i),
+		})
+	}
+	return settings
+}
+
+func missingSetting(name string) error {
+	setting := setting{name: name}
+	return fmt.Errorf("%s is required, set it in the config file, as %s, %s_FILE or with --%s", name, setting.env(), setting.env(), name)
+}
+
+// settingFlag collects the value of a flag, it's only applied once the config file and environment were read
+type settingFlag struct {
+	kind  reflect.Kind
+	value string
+}
+
+func (flag *settingFlag) String() string {
+	return flag.value
+}
+
+func (flag *settingFlag) Set(value string) error {
+	flag.value = value
+	return nil
+}
+
+func (flag *settingFlag) IsBoolFlag() bool {
+	return flag.kind == reflect.Bool
+}
+
+// LoadConfig builds the config from these layers, each one overriding the ones before it:
+//   - the defaults
+//   - the JSON config file passed with --config or CONFIG_FILE
+//   - the JSON in the CONFIG environment variable
+//   - the deprecated POSTGRES_* variables, which replace a postgres_uri of the file or CONFIG like they did in older versions
+//   - an environment variable per setting, like COSMETICS_API_TOKEN, or COSMETICS_API_TOKEN_FILE to read it from a file
+//   - a flag per setting, like --api_token
+//
+// The flags are added to the given flag set before it parses the arguments, so callers can add their own flags
+// and read the arguments left after the flags.
+func LoadConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// LoadDatabaseConfig loads the config like LoadConfig, but only requires the settings checked by ValidateDatabase
+func LoadDatabaseConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return config, err
+	}
+	return config, config.ValidateDatabase()
+}
+
+func loadConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	config := defaultConfig()
+	settings := settingsOf(&config)
+
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "JSON config file, defaults to CONFIG_FILE")
+	values := make([]*settingFlag, len(settings))
+	for i, setting := range settings {
+		values[i] = &settingFlag{kind: setting.value.Kind()}
+		flags.Var(values[i], setting.name, "Overrides "+setting.env())
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return config, err
+	}
+
+	if *file != "" {
+		config.files = append(config.files, *file)
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return config, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// Unlike the environment, the file belongs to this service, so an unknown key is most likely a typo
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return config, fmt.Errorf("failed to parse config file %s: %w", *file, err)
+		}
+	}
+	if env := os.Getenv("CONFIG"); env != "" {
+		if err := json.Unmarshal([]byte(env), &config); err != nil {
+			return config, fmt.Errorf("failed to parse CONFIG: %w", err)
+		}
+	}
+
+	if uri := legacyPostgresUri(); uri != "" {
+		config.warnings = append(config.warnings, utils.LogData{
+			Message: "The POSTGRES_* variables are deprecated, set postgres_uri instead",
+			Data:    missingSetting("postgres_uri").Error(),
+			Level:   slog.LevelWarn,
+		})
+		if config.PostgresUri != "" && config.PostgresUri != uri {
+			config.warnings = append(config.warnings, utils.LogData{
+				Message: "Both postgres_uri and the POSTGRES_* variables are set, postgres_uri is ignored like in older versions",
+				Data:    "Remove the POSTGRES_* variables to use postgres_uri",
+				Level:   slog.LevelWarn,
+			})
+		}
+		config.PostgresUri = uri
+	}
+
+	var errs []error
+	for _, setting := range settings {
+		raw, ok, err := lookupEnv(setting.env())
+		if err == nil && ok {
+			err = setting.set(raw)
+		}
+		errs = append(errs, err)
+		if file, ok := os.LookupEnv(setting.env() + "_FILE"); ok {
+			config.files = append(config.files, file)
+		}
+	}
+	flags.Visit(func(flag *flag.Flag) {
+		if value, ok := flag.Value.(*settingFlag); ok {
+			i := slices.Index(values, value)
+			errs = append(errs, settings[i].set(value.value))
+		}
+	})
+	return config, errors.Join(errs...)
+}
+
+// legacyPostgresUri builds the uri from the POSTGRES_* variables read by older versions, so existing deployments keep working
+func legacyPostgresUri() string {
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		return ""
+	}
+	if port := os.Getenv("POSTGRES_PORT"); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	uri := url.URL{
+		Scheme: "postgresql",
+		User:   url.UserPassword(os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD")),
+		Host:   host,
+		Path:   "/" + os.Getenv("POSTGRES_DB"),
+	}
+	return uri.String()
+}
+
+// lookupEnv reads a setting either from the variable itself or from the file named by its _FILE variable,
+// which is how secrets are usually mounted
+func lookupEnv(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	file, fromFile := os.LookupEnv(name + "_FILE")
+	if !fromFile {
+		return value, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// LogWarnings logs what is deprecated or ignored in the config. It's called once logging is set up, reloads don't repeat it.
+func (conf Config) LogWarnings() {
+	for _, warning := range conf.warnings {
+		warning.Log()
+	}
+}
+
+// Redacted returns a copy that is safe to print, secrets are replaced and database uris only lose their password
+func (conf Config) Redacted() Config {
+	for _, setting := range settingsOf(&conf) {
+		if !setting.secret || setting.value.String() == "" {
+			continue
+		}
+		if strings.HasSuffix(setting.name, "uri") {
+			setting.value.SetString(redactUri(setting.value.String()))
+		} else {
+			setting.value.SetString(redactedSecret)
+		}
+	}
+	return conf
+}
+
+// redactUri keeps everything but the password of an url, other connection strings are redacted entirely
+func redactUri(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return redactedSecret
+	}
+	query := parsed.Query()
+	if query.Has("password") {
+		query.Set("password", "xxxxx")
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.Redacted()
+}
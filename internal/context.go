@@ -2,87 +2,103 @@ package internal
 
 import (
 	"context"
-	"database/sql"
-	"embed"
-	"errors"
+	"cosmetics/utils"
 	"fmt"
-	"os"
-
-	"github.com/golang-migrate/migrate/v4"
-	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx/v5"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type RouteContext struct {
-	Config  *Config
-	Pool    *pgxpool.Pool
+	// config is swapped as a whole when the config is reloaded, read it through Config
+	config  *atomic.Pointer[Config]
+	Store   Store
 	Context context.Context
+	Changes *ChangeListener
+	Health  *Health
 }
 
-func (conf Config) dbUri() string {
-	if conf.DevMode {
-		return conf.PostgresUri
-	} else {
-		user := os.Getenv("POSTGRES_USER")
-		password := os.Getenv("POSTGRES_PASSWORD")
-		host := os.Getenv("POSTGRES_HOST")
-		port := os.Getenv("POSTGRES_PORT")
-		db := os.Getenv("POSTGRES_DB")
-		return fmt.Sprintf("postgresql://%s:%s@%s:%s/%s", user, password, host, port, db)
+// newStore sets up the configured storage along with the change listener that reports its changes
+func newStore(ctx context.Context, config Config) (Store, *ChangeListener, error) {
+	if config.Storage == StorageMemory {
+		changes := NewChangeListener(nil)
+		return NewMemoryStore(changes), changes, nil
+	}
+	store, err := NewPostgresStore(ctx, config)
+	if err != nil {
+		return nil, nil, err
 	}
+	changes := NewChangeListener(store.pool)
+	// Changes written by other instances keep the reads on the primary as well
+	changes.OnChange(func(Change) {
+		store.reads.Written()
+	})
+	return store, changes, nil
 }
 
-func NewRouteContext() RouteContext {
-	config := NewConfig()
-
+// NewRouteContext sets up the store without connecting to it, see Connect
+func NewRouteContext(config Config) (RouteContext, error) {
 	ctx := context.Background()
-	pool, err := pgxpool.New(ctx, config.dbUri())
+	store, changes, err := newStore(ctx, config)
 	if err != nil {
-		panic(err)
+		return RouteContext{}, err
 	}
-	err = pool.Ping(ctx)
-	if err != nil {
-		panic(err)
-	}
-
-	routeContext := RouteContext{&config, pool, ctx}
+	current := new(atomic.Pointer[Config])
+	current.Store(&config)
+	return RouteContext{
+		config:  current,
+		Store:   store,
+		Context: ctx,
+		Changes: changes,
+		Health:  NewHealth(),
+	}, nil
+}
 
-	setupDatabase(&routeContext)
+// Config returns the current config, settings that can change while running must be read again instead of being kept around
+func (ctx RouteContext) Config() *Config {
+	return ctx.config.Load()
+}
 
-	return routeContext
+// ForRequest carries the trace and log attributes of the request into its queries,
+// without canceling them when the client goes away, so a started write is always finished
+func (ctx RouteContext) ForRequest(req *http.Request) RouteContext {
+	ctx.Context = context.WithoutCancel(req.Context())
+	return ctx
 }
 
-//go:embed migrations/*.sql
-var migrationFS embed.FS
+// Connect waits for the database to accept connections and migrates it, retrying with a backoff until the configured deadline.
+// The server keeps running in the meantime, so the health reports why it isn't ready yet, it's marked ready once the rest of the startup is done.
+func (ctx RouteContext) Connect() error {
+	const maxBackoff = 15 * time.Second
+	timeout := ctx.Config().Startup.ConnectTimeoutDuration()
+	deadline := time.Now().Add(timeout)
+	connectContext, cancel := context.WithDeadline(ctx.Context, deadline)
+	defer cancel()
 
-func setupDatabase(ctx *RouteContext) {
-	// Create a dedicated connection for migrations because migrate wont take a pgx conn (needs database/sql conn)
-	migrateConn, err := sql.Open("pgx", ctx.Config.dbUri())
-	if err != nil {
-		panic(fmt.Sprintf("failed to acquire connection for migrations: %w", err))
-	}
-	//goland:noinspection GoUnhandledErrorResult
-	defer migrateConn.Close()
-	migrateDriver, err := migratepgx.WithInstance(migrateConn, &migratepgx.Config{
-		MigrationsTable: "cosmetics_migrations",
-	})
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := ctx.Store.Ping(connectContext)
+		if err == nil {
+			break
+		}
+		if ctx.Context.Err() != nil {
+			return ctx.Context.Err()
+		}
 
-	if err != nil {
-		panic(fmt.Sprintf("failed to create migrate driver: %w", err))
-	}
-	migrateSource, err := iofs.New(migrationFS, "migrations")
-	if err != nil {
-		panic(fmt.Sprintf("failed to create migrate source: %w", err))
-	}
-	m, err := migrate.NewWithInstance("migration-fs", migrateSource, "migration-db", migrateDriver)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create migrate instance: %w", err))
+		message := fmt.Sprintf("Waiting for database, attempt %d failed: %v", attempt, err)
+		ctx.Health.SetStarting(message)
+		utils.LogData{Message: message}.Log()
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("database not reachable within %s after %d attempts: %w", timeout, attempt, err)
+		}
+		select {
+		case <-connectContext.Done():
+			return connectContext.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
 	}
 
-	// Apply all migrations up to the latest
-	err = m.Up()
-	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		panic(fmt.Sprintf("failed to apply migrations: %w", err))
-	}
+	ctx.Health.SetStarting("Applying migrations")
+	return ctx.Store.Migrate(ctx.Context)
 }
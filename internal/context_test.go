@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var errConnectionRefused = errors.New("dial tcp: connection refused")
+
+// flakyStore fails to ping until it was pinged the given number of times
+type flakyStore struct {
+	Store
+	failures int
+	pings    int
+	migrated bool
+}
+
+func (store *flakyStore) Ping(context.Context) error {
+	store.pings++
+	if store.pings <= store.failures {
+		return errConnectionRefused
+	}
+	return nil
+}
+
+func (store *flakyStore) Migrate(ctx context.Context) error {
+	store.migrated = true
+	return store.Store.Migrate(ctx)
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		timeout  int
+		pings    int
+		err      string
+	}{
+		{"reachable", 0, 10, 1, ""},
+		{"reachable after a retry", 1, 10, 2, ""},
+		{"not reachable in time", 100, 1, 1, "database not reachable within 1s after 1 attempts"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.Storage = StorageMemory
+			config.Startup.ConnectTimeout = test.timeout
+			ctx, err := NewRouteContext(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &flakyStore{Store: ctx.Store, failures: test.failures}
+			ctx.Store = store
+
+			err = ctx.Connect()
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err) || !errors.Is(err, errConnectionRefused)) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+			if store.pings != test.pings || store.migrated != (test.err == "") {
+				t.Errorf("expected %d pings and a migration only once connected, got %d pings and migrated %v", test.pings, store.pings, store.migrated)
+			}
+			status := ctx.Health.Status()
+			if status.Ready {
+				t.Error("connecting must not mark the instance as ready, the rest of the startup does")
+			}
+			if test.err != "" && !strings.Contains(status.Message, errConnectionRefused.Error()) {
+				t.Errorf("expected the health to tell why startup waits, got %q", status.Message)
+			}
+		})
+	}
+}
+
+func TestConnectCanceled(t *testing.T) {
+	config := defaultConfig()
+	config.Storage = StorageMemory
+	ctx, err := NewRouteContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Store = &flakyStore{Store: ctx.Store, failures: 100}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.Context = canceled
+
+	if err := ctx.Connect(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected connecting to stop once the context is done, got %v", err)
+	}
+}
+
+func TestNewRouteContextInvalidUri(t *testing.T) {
+	config := validConfig()
+	config.PostgresUri = "postgres://cosmetics@localhost:not-a-port/cosmetics"
+	_, err := NewRouteContext(config)
+	if err == nil || !strings.Contains(err.Error(), "invalid postgres connection settings") {
+		t.Errorf("expected invalid connection settings to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"cosmetics/utils"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// IsUnavailable reports whether the error means the database could not be reached at all,
+// errors returned by postgres itself mean it's reachable and are left to the caller.
+func IsUnavailable(err error) bool {
+	if err == nil || errors.Is(err, pgx.ErrNoRows) || isStoreError(err) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	return !errors.As(err, &pgErr)
+}
+
+// Health tracks whether startup finished and the database is reachable, while it isn't the server runs degraded on stale data
+type Health struct {
+	mutex    sync.RWMutex
+	ready    bool
+	stopping bool
+	message  string
+	degraded bool
+	since    time.Time
+}
+
+type HealthStatus struct {
+	Ready         bool       `json:"ready"`
+	Message       string     `json:"message,omitempty"`
+	Degraded      bool       `json:"degraded"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+}
+
+func NewHealth() *Health {
+	return &Health{message: "Starting"}
+}
+
+// SetStarting reports what startup is currently waiting for
+func (health *Health) SetStarting(message string) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if health.stopping {
+		return
+	}
+	health.ready = false
+	health.message = message
+}
+
+func (health *Health) SetReady() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if health.stopping {
+		return
+	}
+	health.ready = true
+	health.message = ""
+}
+
+// SetStopping fails the health for good, so no new requests are routed here while shutting down
+func (health *Health) SetStopping() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.stopping = true
+	health.ready = false
+	health.message = "Shutting down"
+}
+
+func (health *Health) Ready() bool {
+	health.mutex.RLock()
+	defer health.mutex.RUnlock()
+	return health.ready
+}
+
+// Observe updates the state from the result of a database operation
+func (health *Health) Observe(err error) {
+	unavailable := IsUnavailable(err)
+
+	health.mutex.RLock()
+	changed := health.degraded != unavailable
+	health.mutex.RUnlock()
+	if !changed {
+		return
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if health.degraded == unavailable {
+		return
+	}
+	health.degraded = unavailable
+	health.since = time.Now()
+	if unavailable {
+		utils.LogData{
+			Message: "Database unavailable, running degraded",
+			Data:    err.Error(),
+			Level:   slog.LevelError,
+		}.Log()
+	} else {
+		utils.LogData{Message: "Database available again"}.Log()
+	}
+}
+
+func (health *Health) Status() HealthStatus {
+	health.mutex.RLock()
+	defer health.mutex.RUnlock()
+	status := HealthStatus{Ready: health.ready, Message: health.message, Degraded: health.degraded}
+	if health.degraded {
+		since := health.since
+		status.DegradedSince = &since
+	}
+	return status
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"cosmetics/utils"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const ChangeChannel = "cosmetics_changes"
+
+const (
+	CosmeticUpdated   = "cosmetic_updated"
+	CosmeticDeleted   = "cosmetic_deleted"
+	GrantAdded        = "grant_added"
+	GrantRemoved      = "grant_removed"
+	PlayerDataUpdated = "player_data_updated"
+	PlayerDeleted     = "player_deleted"
+	// Anything may have changed, everything derived from the dataset has to be read again
+	DatasetImported = "dataset_imported"
+)
+
+type Change struct {
+	Id       int64  `json:"id"`
+	Type     string `json:"type"`
+	Player   string `json:"player,omitempty"`
+	Cosmetic string `json:"cosmetic,omitempty"`
+}
+
+// RecordChange appends the change to the change log and through that tells every replica, including this one, about it
+func RecordChange(ctx RouteContext, change Change) {
+	err := ctx.Store.RecordChange(ctx.Context, change)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to record change",
+			Data:    err.Error(),
+			Level:   slog.LevelError,
+		}.Log()
+	}
+}
+
+// ChangeListener holds a dedicated LISTEN connection and forwards notifications to its subscribers.
+// Notifications sent while the connection was down are lost, so subscribers are told to resync after a reconnect.
+type ChangeListener struct {
+	pool  *pgxpool.Pool
+	mutex sync.RWMutex
+	// ready is closed once the first LISTEN went through
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	nextHandler       int
+	changeHandlers    map[int]func(Change)
+	reconnectHandlers map[int]func()
+}
+
+func NewChangeListener(pool *pgxpool.Pool) *ChangeListener {
+	listener := &ChangeListener{
+		pool:              pool,
+		ready:             make(chan struct{}),
+		changeHandlers:    make(map[int]func(Change)),
+		reconnectHandlers: make(map[int]func()),
+	}
+	// The memory store hands over its changes directly, there is no connection to wait for
+	if pool == nil {
+		listener.setReady()
+	}
+	return listener
+}
+
+// Ready is closed once the listener receives notifications, every change committed after that reaches the handlers
+func (listener *ChangeListener) Ready() <-chan struct{} {
+	return listener.ready
+}
+
+func (listener *ChangeListener) setReady() {
+	listener.readyOnce.Do(func() {
+		close(listener.ready)
+	})
+}
+
+// OnChange registers a handler for every received change, the returned function removes it again
+func (listener *ChangeListener) OnChange(handler func(Change)) func() {
+	return register(listener, listener.changeHandlers, handler)
+}
+
+// OnReconnect registers a handler that is called after the connection was lost, the returned function removes it again
+func (listener *ChangeListener) OnReconnect(handler func()) func() {
+	return register(listener, listener.reconnectHandlers, handler)
+}
+
+func register[T any](listener *ChangeListener, handlers map[int]T, handler T) func() {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	id := listener.nextHandler
+	listener.nextHandler++
+	handlers[id] = handler
+
+	return func() {
+		listener.mutex.Lock()
+		defer listener.mutex.Unlock()
+		delete(handlers, id)
+	}
+}
+
+// Listen blocks until the context is done, reconnecting with a backoff whenever the connection is lost.
+// Without a pool there is nothing to listen to, the memory store hands its changes over directly.
+func (listener *ChangeListener) Listen(ctx context.Context) {
+	if listener.pool == nil {
+		<-ctx.Done()
+		return
+	}
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+	connectedBefore := false
+
+	for ctx.Err() == nil {
+		err := listener.listen(ctx, func() {
+			if connectedBefore {
+				utils.LogData{Message: "Reconnected change listener"}.Log()
+				listener.reconnected()
+			}
+			connectedBefore = true
+			backoff = time.Second
+			listener.setReady()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		utils.LogData{
+			Message: "Change listener disconnected",
+			Data:    err.Error(),
+			Level:   slog.LevelWarn,
+		}.Log()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (listener *ChangeListener) listen(ctx context.Context, connected func()) error {
+	pooled, err := listener.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection keeps listening until closed, so it must never go back into the pool
+	conn := pooled.Hijack()
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "listen "+pgx.Identifier{ChangeChannel}.Sanitize())
+	if err != nil {
+		return err
+	}
+	connected()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change Change
+		err = json.Unmarshal([]byte(notification.Payload), &change)
+		if err != nil {
+			utils.LogData{
+				Message: "Received invalid change notification",
+				Data:    notification.Payload,
+				Level:   slog.LevelWarn,
+			}.Log()
+			continue
+		}
+		listener.changed(change)
+	}
+}
+
+// changed calls the handlers in the order they were registered, so handlers registered along with the store run before the others
+func (listener *ChangeListener) changed(change Change) {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	for _, id := range slices.Sorted(maps.Keys(listener.changeHandlers)) {
+		listener.changeHandlers[id](change)
+	}
+}
+
+func (listener *ChangeListener) reconnected() {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	for _, id := range slices.Sorted(maps.Keys(listener.reconnectHandlers)) {
+		listener.reconnectHandlers[id]()
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestChangeListenerHandlers(t *testing.T) {
+	listener := NewChangeListener(nil)
+	var calls []string
+	removeFirst := listener.OnChange(func(change Change) {
+		calls = append(calls, "first "+change.Type)
+	})
+	listener.OnChange(func(change Change) {
+		calls = append(calls, "second "+change.Type)
+	})
+	listener.OnReconnect(func() {
+		calls = append(calls, "reconnect")
+	})
+
+	listener.changed(Change{Type: GrantAdded})
+	removeFirst()
+	listener.changed(Change{Type: GrantRemoved})
+	listener.reconnected()
+
+	want := []string{"first grant_added", "second grant_added", "second grant_removed", "reconnect"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %v, got %v", want, calls)
+	}
+}
+
+// The payloads are built by the notify_change trigger of the 000003_change_log migration
+func TestChangeNotificationPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    Change
+	}{
+		{
+			`{"id" : 7, "type" : "grant_added", "player" : "e90ea9ec-080a-401b-8d10-6a53c407ac53", "cosmetic" : "default"}`,
+			Change{Id: 7, Type: GrantAdded, Player: "e90ea9ec-080a-401b-8d10-6a53c407ac53", Cosmetic: "default"},
+		},
+		{
+			`{"id" : 8, "type" : "cosmetic_deleted", "player" : null, "cosmetic" : "default"}`,
+			Change{Id: 8, Type: CosmeticDeleted, Cosmetic: "default"},
+		},
+	}
+	for _, test := range tests {
+		var change Change
+		if err := json.Unmarshal([]byte(test.payload), &change); err != nil {
+			t.Fatal(err)
+		}
+		if change != test.want {
+			t.Errorf("expected %+v, got %+v", test.want, change)
+		}
+	}
+}
+
+func TestChangeListenerWithoutPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewChangeListener(nil).Listen(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Listen to return once the context is done")
+	}
+}
+
+func TestChangeListenerReady(t *testing.T) {
+	select {
+	case <-NewChangeListener(nil).Ready():
+	default:
+		t.Error("expected a listener without pool to be ready right away")
+	}
+
+	// Nothing listens on port 1, so the listener never gets to LISTEN
+	pool, err := pgxpool.New(context.Background(), "postgres://cosmetics@127.0.0.1:1/cosmetics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	listener := NewChangeListener(pool)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	listener.Listen(ctx)
+	select {
+	case <-listener.Ready():
+		t.Error("expected the listener not to be ready before LISTEN went through")
+	default:
+	}
+}
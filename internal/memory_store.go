@@ -0,0 +1,489 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"cosmetics/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// The entries of the 000002_default_data migration, a migrated memory store starts out like a migrated database
+const (
+	defaultPlayer       = "e90ea9ec-080a-401b-8d10-6a53c407ac53"
+	defaultPlayerData   = `{"default": "data"}`
+	defaultCosmetic     = "default"
+	defaultCosmeticData = `{}`
+)
+
+// memoryData holds the tables, data is only ever replaced and never modified in place, so it can be handed out without copying
+type memoryData struct {
+	cosmetics map[string]StoredCosmetic
+	players   map[string]json.RawMessage
+	// The ids of the granted cosmetics by player
+	grants map[string]map[string]bool
+}
+
+func newMemoryData() memoryData {
+	return memoryData{
+		cosmetics: make(map[string]StoredCosmetic),
+		players:   make(map[string]json.RawMessage),
+		grants:    make(map[string]map[string]bool),
+	}
+}
+
+func (data memoryData) clone() memoryData {
+	clone := memoryData{
+		cosmetics: maps.Clone(data.cosmetics),
+		players:   maps.Clone(data.players),
+		grants:    make(map[string]map[string]bool, len(data.grants)),
+	}
+	for player, cosmetics := range data.grants {
+		clone.grants[player] = maps.Clone(cosmetics)
+	}
+	return clone
+}
+
+// putCosmetic checks the same constraints as the cosmetics table
+func (data memoryData) putCosmetic(cosmetic StoredCosmetic) error {
+	if !utils.IsValidResourceLocationNamespace(cosmetic.Id) {
+		return fmt.Errorf("%w: cosmetic id %q", ErrInvalid, cosmetic.Id)
+	}
+	if cosmetic.Version != nil && *cosmetic.Version < 1 {
+		return fmt.Errorf("%w: version %d of cosmetic %s", ErrInvalid, *cosmetic.Version, cosmetic.Id)
+	}
+	if !json.Valid(cosmetic.Data) {
+		return fmt.Errorf("%w: data of cosmetic %s", ErrInvalid, cosmetic.Id)
+	}
+	if cosmetic.Version != nil {
+		version := *cosmetic.Version
+		cosmetic.Version = &version
+	}
+	cosmetic.Data = slices.Clone(cosmetic.Data)
+	data.cosmetics[cosmetic.Id] = cosmetic
+	return nil
+}
+
+func (data memoryData) deleteCosmetic(id string) bool {
+	if _, found := data.cosmetics[id]; !found {
+		return false
+	}
+	delete(data.cosmetics, id)
+	for _, cosmetics := range data.grants {
+		delete(cosmetics, id)
+	}
+	return true
+}
+
+func (data memoryData) setPlayerData(id string, value json.RawMessage) error {
+	if !json.Valid(value) {
+		return fmt.Errorf("%w: data of player %s", ErrInvalid, id)
+	}
+	data.players[id] = slices.Clone(value)
+	return nil
+}
+
+func (data memoryData) deletePlayer(id string) bool {
+	if _, found := data.players[id]; !found {
+		return false
+	}
+	delete(data.players, id)
+	delete(data.grants, id)
+	return true
+}
+
+func (data memoryData) grant(player string, cosmetic string) error {
+	if _, found := data.players[player]; !found {
+		return fmt.Errorf("%w: player %s", ErrNotFound, player)
+	}
+	if _, found := data.cosmetics[cosmetic]; !found {
+		return fmt.Errorf("%w: %s", ErrUnknownCosmetic, cosmetic)
+	}
+	if data.grants[player][cosmetic] {
+		return ErrAlreadyGranted
+	}
+	if data.grants[player] == nil {
+		data.grants[player] = make(map[string]bool)
+	}
+	data.grants[player][cosmetic] = true
+	return nil
+}
+
+// player builds the player the way the players_with_cosmetics view does
+func (data memoryData) player(id string) (Player, bool, error) {
+	raw, found := data.players[id]
+	if !found {
+		return Player{}, false, nil
+	}
+	player := Player{Player: id, Cosmetics: utils.SortedKeys(data.grants[id])}
+	err := json.Unmarshal(raw, &player.Data)
+	if err != nil {
+		return player, false, fmt.Errorf("failed to decode data of player %s: %w", id, err)
+	}
+	return player, true, nil
+}
+
+func (data memoryData) dataset() Dataset {
+	dataset := Dataset{
+		Cosmetics: make([]StoredCosmetic, 0, len(data.cosmetics)),
+		Players:   make([]StoredPlayer, 0, len(data.players)),
+		Grants:    make([]Grant, 0),
+	}
+	for _, id := range utils.SortedKeys(data.cosmetics) {
+		dataset.Cosmetics = append(dataset.Cosmetics, data.cosmetics[id])
+	}
+	for _, id := range utils.SortedKeys(data.players) {
+		dataset.Players = append(dataset.Players, StoredPlayer{Id: id, Data: data.players[id]})
+		for _, cosmetic := range utils.SortedKeys(data.grants[id]) {
+			dataset.Grants = append(dataset.Grants, Grant{Player: id, Cosmetic: cosmetic})
+		}
+	}
+	return dataset
+}
+
+// MemoryStore keeps everything in maps, with the same semantics as the Postgres store. Nothing survives a restart and other instances
+// don't see the data, so it's meant for running the api locally and in tests. Changes are handed to the change listener directly.
+type MemoryStore struct {
+	changes *ChangeListener
+	// Held from recording a change until its handlers returned, so changes are notified in the order of their ids.
+	// It's taken before mutex, never while holding it.
+	notifyMutex sync.Mutex
+
+	mutex        sync.RWMutex
+	data         memoryData
+	changeLog    []Change
+	lastChangeId int64
+	migration    uint
+}
+
+// NewMemoryStore creates an empty store, migrating it adds the default entries a migrated database has
+func NewMemoryStore(changes *ChangeListener) *MemoryStore {
+	return &MemoryStore{changes: changes, data: newMemoryData()}
+}
+
+func (store *MemoryStore) PutCosmetic(_ context.Context, cosmetic StoredCosmetic) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.data.putCosmetic(cosmetic)
+}
+
+func (store *MemoryStore) Cosmetic(_ context.Context, id string) (json.RawMessage, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	cosmetic, found := store.data.cosmetics[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return cosmetic.Data, nil
+}
+
+// decodeCosmetic decodes a definition like the Postgres store does, definitions that aren't an object are skipped
+func decodeCosmetic(cosmetic StoredCosmetic) (map[string]interface{}, bool) {
+	var definition map[string]interface{}
+	err := json.Unmarshal(cosmetic.Data, &definition)
+	return definition, err == nil && definition != nil
+}
+
+func (store *MemoryStore) CosmeticsByIds(_ context.Context, ids []string) ([]interface{}, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	cosmetics := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if definition, ok := decodeCosmetic(store.data.cosmetics[id]); ok {
+			cosmetics = append(cosmetics, definition)
+		}
+	}
+	return cosmetics, nil
+}
+
+func (store *MemoryStore) DeleteCosmetic(_ context.Context, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if !store.data.deleteCosmetic(id) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *MemoryStore) CosmeticIds(_ context.Context) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return utils.SortedKeys(store.data.cosmetics), nil
+}
+
+func (store *MemoryStore) CreatePlayer(_ context.Context, id string) (bool, error) {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return false, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, found := store.data.players[id]; found {
+		return false, nil
+	}
+	store.data.players[id] = json.RawMessage(`{}`)
+	return true, nil
+}
+
+func (store *MemoryStore) SetPlayerData(_ context.Context, id string, data json.RawMessage) error {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.data.setPlayerData(id, data)
+}
+
+func (store *MemoryStore) PlayerData(_ context.Context, id string) (json.RawMessage, error) {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return nil, err
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	data, found := store.data.players[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (store *MemoryStore) DeletePlayer(_ context.Context, id string) error {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if !store.data.deletePlayer(id) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *MemoryStore) Player(_ context.Context, id string) (Player, error) {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return Player{}, err
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	player, found, err := store.data.player(id)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return player, err
+}
+
+func (store *MemoryStore) PlayersByIds(_ context.Context, ids []string) ([]Player, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	players := make([]Player, 0, len(ids))
+	for _, id := range ids {
+		id, err := parsePlayerId(id)
+		if err != nil {
+			return nil, err
+		}
+		player, found, err := store.data.player(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			players = append(players, player)
+		}
+	}
+	return players, nil
+}
+
+func (store *MemoryStore) PlayerIds(_ context.Context) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return utils.SortedKeys(store.data.players), nil
+}
+
+func (store *MemoryStore) Grant(_ context.Context, player string, cosmetic string) error {
+	player, err := parsePlayerId(player)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.data.grant(player, cosmetic)
+}
+
+func (store *MemoryStore) Revoke(_ context.Context, player string, cosmetic string) error {
+	player, err := parsePlayerId(player)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if !store.data.grants[player][cosmetic] {
+		return ErrNotFound
+	}
+	delete(store.data.grants[player], cosmetic)
+	return nil
+}
+
+func (store *MemoryStore) Entries(_ context.Context) ([]interface{}, []Player, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	cosmetics := make([]interface{}, 0, len(store.data.cosmetics))
+	for _, id := range utils.SortedKeys(store.data.cosmetics) {
+		if definition, ok := decodeCosmetic(store.data.cosmetics[id]); ok {
+			cosmetics = append(cosmetics, definition)
+		}
+	}
+	players := make([]Player, 0, len(store.data.players))
+	for _, id := range utils.SortedKeys(store.data.players) {
+		player, _, err := store.data.player(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		players = append(players, player)
+	}
+	return cosmetics, players, nil
+}
+
+func (store *MemoryStore) Export(_ context.Context) (Dataset, uint, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.data.dataset(), store.migration, nil
+}
+
+// Import applies the dataset to a copy, which only replaces the current data once everything was applied
+func (store *MemoryStore) Import(_ context.Context, dataset Dataset, replace bool, dryRun bool) (Dataset, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	current := store.data.dataset()
+
+	next := store.data.clone()
+	if replace {
+		next = newMemoryData()
+	}
+	for _, cosmetic := range dataset.Cosmetics {
+		if err := next.putCosmetic(cosmetic); err != nil {
+			return current, err
+		}
+	}
+	for _, player := range dataset.Players {
+		id, err := parsePlayerId(player.Id)
+		if err == nil {
+			err = next.setPlayerData(id, player.Data)
+		}
+		if err != nil {
+			return current, err
+		}
+	}
+	for _, grant := range dataset.Grants {
+		player, err := parsePlayerId(grant.Player)
+		if err == nil {
+			err = next.grant(player, grant.Cosmetic)
+		}
+		if err != nil && !errors.Is(err, ErrAlreadyGranted) {
+			return current, err
+		}
+	}
+	if !dryRun {
+		store.data = next
+	}
+	return current, nil
+}
+
+func (store *MemoryStore) RecordChange(_ context.Context, change Change) error {
+	if change.Player != "" {
+		player, err := parsePlayerId(change.Player)
+		if err != nil {
+			return err
+		}
+		change.Player = player
+	}
+	store.notifyMutex.Lock()
+	defer store.notifyMutex.Unlock()
+	store.mutex.Lock()
+	store.lastChangeId++
+	change.Id = store.lastChangeId
+	store.changeLog = append(store.changeLog, change)
+	store.mutex.Unlock()
+
+	// Handlers read from the store, so they are called without holding the data lock
+	store.changes.changed(change)
+	return nil
+}
+
+func (store *MemoryStore) ChangesSince(_ context.Context, id int64, limit int) ([]Change, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	start, _ := slices.BinarySearchFunc(store.changeLog, id+1, func(change Change, id int64) int {
+		return cmp.Compare(change.Id, id)
+	})
+	end := min(start+max(limit, 0), len(store.changeLog))
+	return slices.Clone(store.changeLog[start:end]), nil
+}
+
+func (store *MemoryStore) LatestChangeId(_ context.Context) (int64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.lastChangeId, nil
+}
+
+func (store *MemoryStore) OldestChangeId(_ context.Context) (int64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if len(store.changeLog) == 0 {
+		return 0, nil
+	}
+	return store.changeLog[0].Id, nil
+}
+
+func (store *MemoryStore) PruneChanges(_ context.Context, keep int) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	pruned := max(len(store.changeLog)-max(keep, 0), 0)
+	store.changeLog = slices.Clone(store.changeLog[pruned:])
+	return int64(pruned), nil
+}
+
+func (store *MemoryStore) Ping(_ context.Context) error {
+	return nil
+}
+
+// Migrate adds the default entries once, like the migrations do for a database, entries that already exist are kept
+func (store *MemoryStore) Migrate(_ context.Context) error {
+	latest, err := LatestMigration()
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.migration == 0 {
+		if _, found := store.data.cosmetics[defaultCosmetic]; !found {
+			version := 1
+			store.data.cosmetics[defaultCosmetic] = StoredCosmetic{Id: defaultCosmetic, Version: &version, Data: json.RawMessage(defaultCosmeticData)}
+		}
+		if _, found := store.data.players[defaultPlayer]; !found {
+			store.data.players[defaultPlayer] = json.RawMessage(defaultPlayerData)
+		}
+		err := store.data.grant(defaultPlayer, defaultCosmetic)
+		if err != nil && !errors.Is(err, ErrAlreadyGranted) {
+			return err
+		}
+	}
+	store.migration = latest
+	return nil
+}
+
+func (store *MemoryStore) MigrationVersion(_ context.Context) (uint, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.migration, false, nil
+}
+
+func (store *MemoryStore) Monitor(_ context.Context) {}
+
+func (store *MemoryStore) Close() {}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"cosmetics/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MetricsNamespace prefixes every metric of the service
+const MetricsNamespace = "cosmetics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Handled requests by route pattern, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time until a request was handled by route pattern, method and status, streams count until they close.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route", "method", "status"})
+)
+
+// ObserveRequests counts requests by their route pattern instead of the path, so the number of series stays bounded
+func ObserveRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := utils.NewStatusRecorder(res)
+		next.ServeHTTP(recorder, req)
+
+		route := req.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(recorder.Status())
+		httpRequests.WithLabelValues(route, req.Method, status).Inc()
+		httpDuration.WithLabelValues(route, req.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// poolCollector reads the pool statistics on every scrape
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquired       *prometheus.Desc
+	idle           *prometheus.Desc
+	constructing   *prometheus.Desc
+	total          *prometheus.Desc
+	max            *prometheus.Desc
+	acquires       *prometheus.Desc
+	waitedAcquires *prometheus.Desc
+	waited         *prometheus.Desc
+}
+
+// RegisterPoolMetrics exports the statistics of the pool, labeled with its name as there may be a replica pool as well
+func RegisterPoolMetrics(name string, pool *pgxpool.Pool) {
+	labels := prometheus.Labels{"pool": name}
+	describe := func(metric string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "db_pool", metric), help, nil, labels)
+	}
+	prometheus.MustRegister(&poolCollector{
+		pool:           pool,
+		acquired:       describe("acquired_connections", "Connections currently in use."),
+		idle:           describe("idle_connections", "Connections currently idle."),
+		constructing:   describe("constructing_connections", "Connections currently being opened."),
+		total:          describe("connections", "Connections currently open."),
+		max:            describe("max_connections", "Maximum size of the pool."),
+		acquires:       describe("acquires_total", "Connections acquired from the pool."),
+		waitedAcquires: describe("waited_acquires_total", "Acquires that had to wait, because no idle connection was available."),
+		waited:         describe("acquire_wait_seconds_total", "Time spent waiting for a connection."),
+	})
+}
+
+func (collector *poolCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.acquired
+	descs <- collector.idle
+	descs <- collector.constructing
+	descs <- collector.total
+	descs <- collector.max
+	descs <- collector.acquires
+	descs <- collector.waitedAcquires
+	descs <- collector.waited
+}
+
+func (collector *poolCollector) Collect(metrics chan<- prometheus.Metric) {
+	stat := collector.pool.Stat()
+	metrics <- prometheus.MustNewConstMetric(collector.acquired, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	metrics <- prometheus.MustNewConstMetric(collector.idle, prometheus.GaugeValue, float64(stat.IdleConns()))
+	metrics <- prometheus.MustNewConstMetric(collector.constructing, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	metrics <- prometheus.MustNewConstMetric(collector.total, prometheus.GaugeValue, float64(stat.TotalConns()))
+	metrics <- prometheus.MustNewConstMetric(collector.max, prometheus.GaugeValue, float64(stat.MaxConns()))
+	metrics <- prometheus.MustNewConstMetric(collector.acquires, prometheus.CounterValue, float64(stat.AcquireCount()))
+	metrics <- prometheus.MustNewConstMetric(collector.waitedAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	metrics <- prometheus.MustNewConstMetric(collector.waited, prometheus.CounterValue, stat.EmptyAcquireWaitTime().Seconds())
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// NewMigrate sets up the embedded migrations for the database, closing it closes its connection as well
+func NewMigrate(uri string) (*migrate.Migrate, error) {
+	// Create a dedicated connection for migrations because migrate wont take a pgx conn (needs database/sql conn)
+	migrateConn, err := sql.Open("pgx", uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection for migrations: %w", err)
+	}
+	migrateDriver, err := migratepgx.WithInstance(migrateConn, &migratepgx.Config{
+		MigrationsTable: "cosmetics_migrations",
+	})
+	if err != nil {
+		_ = migrateConn.Close()
+		return nil, fmt.Errorf("failed to create migrate driver: %w", err)
+	}
+	migrateSource, err := iofs.New(migrationFS, "migrations")
+	if err != nil {
+		_ = migrateDriver.Close()
+		return nil, fmt.Errorf("failed to create migrate source: %w", err)
+	}
+	m, err := migrate.NewWithInstance("migration-fs", migrateSource, "migration-db", migrateDriver)
+	if err != nil {
+		_ = migrateDriver.Close()
+		return nil, fmt.Errorf("failed to create migrate instance: %w", err)
+	}
+	return m, nil
+}
+
+// LatestMigration is the version of the newest migration embedded in this build
+var LatestMigration = sync.OnceValues(func() (uint, error) {
+	source, err := iofs.New(migrationFS, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+})
@@ -0,0 +1,7 @@
+begin;
+
+drop trigger if exists change_log_notify on change_log;
+drop function if exists notify_change();
+drop table if exists change_log;
+
+commit;
@@ -0,0 +1,31 @@
+begin;
+
+create table if not exists change_log
+(
+    id          bigserial primary key,
+    type        varchar     not null,
+    player_id   uuid,
+    cosmetic_id varchar,
+    created_at  timestamptz not null default now()
+);
+
+create or replace function notify_change() returns trigger as
+$$
+begin
+    perform pg_notify('cosmetics_changes', json_build_object(
+            'id', new.id,
+            'type', new.type,
+            'player', new.player_id,
+            'cosmetic', new.cosmetic_id
+        )::text);
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger change_log_notify
+    after insert
+    on change_log
+    for each row
+execute function notify_change();
+
+commit;
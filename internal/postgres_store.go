@@ -0,0 +1,566 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const createCosmeticQuery = `
+	insert into cosmetics(id, version, data) values($1, $2, $3) on conflict (id) do update set version = $2, data = $3
+`
+
+const getCosmeticQuery = `
+	select data from cosmetics where id = $1
+`
+
+const getCosmeticsQuery = `
+	select data from cosmetics where id = any($1)
+`
+
+const deleteCosmeticQuery = `
+	delete from cosmetics where id = $1
+`
+
+const getCosmeticIdsQuery = `
+	select id from cosmetics
+`
+
+const createPlayerQuery = `
+	insert into players(id) values($1) on conflict do nothing;
+`
+
+const setPlayerDataQuery = `
+	insert into players (id, data) values ($1, $2) on conflict (id) do update set data = excluded.data;
+`
+
+const getPlayerDataQuery = `
+	select data from players where id = $1
+`
+
+const deletePlayerQuery = `
+	delete from players where id = $1
+`
+
+const getPlayerQuery = `
+	select player_id, player_data, cosmetics from players_with_cosmetics where player_id = $1 limit 1
+`
+
+const getPlayersQuery = `
+	select player_id, player_data, cosmetics from players_with_cosmetics where player_id = any($1::uuid[])
+`
+
+const getPlayerIdsQuery = `
+	select id::text from players
+`
+
+const addGrantQuery = `
+	insert into player_cosmetics (player_id, cosmetic_id)  values($1, $2) on conflict do nothing;
+`
+
+const removeGrantQuery = `
+	delete from player_cosmetics where player_id = $1 and cosmetic_id = $2
+`
+
+const entriesCosmeticsQuery = `
+	select data from cosmetics
+`
+
+const entriesPlayersQuery = `
+	select player_id as player, player_data as data, cosmetics FROM players_with_cosmetics
+`
+
+const exportCosmeticsQuery = `
+	select id, version, data from cosmetics order by id
+`
+
+const exportPlayersQuery = `
+	select id, data from players order by id
+`
+
+const exportGrantsQuery = `
+	select player_id, cosmetic_id from player_cosmetics order by player_id, cosmetic_id
+`
+
+// Other writes wait for the import, so the returned dataset is the one the import is applied to
+const lockDatasetQuery = `
+	lock table cosmetics, players, player_cosmetics in exclusive mode
+`
+
+const deleteOtherCosmeticsQuery = `
+	delete from cosmetics where id <> all($1)
+`
+
+const deleteOtherPlayersQuery = `
+	delete from players where id <> all($1::uuid[])
+`
+
+const deleteGrantsQuery = `
+	delete from player_cosmetics
+`
+
+// The change_log insert trigger sends the notification, so the log and the notification can never disagree
+const recordChangeQuery = `
+	insert into change_log(type, player_id, cosmetic_id) values ($1, $2, $3)
+`
+
+const latestChangeIdQuery = `
+	select coalesce(max(id), 0) from change_log
+`
+
+const oldestChangeIdQuery = `
+	select coalesce(min(id), 0) from change_log
+`
+
+const changesSinceQuery = `
+	select id, type, coalesce(player_id::text, ''), coalesce(cosmetic_id, '') from change_log where id > $1 order by id limit $2
+`
+
+const pruneChangesQuery = `
+	delete from change_log where id <= (select max(id) from change_log) - $1
+`
+
+const migrationVersionQuery = `
+	select version, dirty from cosmetics_migrations limit 1
+`
+
+// The foreign key of player_cosmetics naming the cosmetic, the other one names the player
+const grantCosmeticConstraint = "player_cosmetics_cosmetic_id_fkey"
+
+// PostgresStore writes to the primary, the public reads go through the read pool which may send them to a replica
+type PostgresStore struct {
+	uri   string
+	pool  *pgxpool.Pool
+	reads *ReadPool
+	// How often the replica is checked
+	checkInterval time.Duration
+}
+
+func newPool(ctx context.Context, uri string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+	config.ConnConfig.Tracer = newQueryTracer()
+	return pgxpool.NewWithConfig(ctx, config)
+}
+
+// NewPostgresStore sets up the pools, creating them doesn't connect yet, connections are only opened once they are needed
+func NewPostgresStore(ctx context.Context, config Config) (*PostgresStore, error) {
+	pool, err := newPool(ctx, config.PostgresUri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid postgres connection settings: %w", err)
+	}
+	RegisterPoolMetrics("primary", pool)
+	var replica *pgxpool.Pool
+	if config.Replica.Uri != "" {
+		replica, err = newPool(ctx, config.Replica.Uri)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("invalid replica connection settings: %w", err)
+		}
+		RegisterPoolMetrics("replica", replica)
+	}
+	return &PostgresStore{
+		uri:           config.PostgresUri,
+		pool:          pool,
+		reads:         NewReadPool(pool, replica, config.Replica.MaxLagDuration()),
+		checkInterval: config.Replica.CheckIntervalDuration(),
+	}, nil
+}
+
+// written keeps the reads on the primary after a successful write
+func (store *PostgresStore) written(err error) error {
+	if err == nil {
+		store.reads.Written()
+	}
+	return err
+}
+
+// constraintError turns the errors of the schema constraints into the errors of the store
+func constraintError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Code {
+	case "23503":
+		if pgErr.ConstraintName == grantCosmeticConstraint {
+			return fmt.Errorf("%w: %s", ErrUnknownCosmetic, pgErr.Detail)
+		}
+		return fmt.Errorf("%w: %s", ErrNotFound, pgErr.Detail)
+	case "23505":
+		return ErrAlreadyGranted
+	case "23514", "22P02":
+		return fmt.Errorf("%w: %s", ErrInvalid, pgErr.Message)
+	}
+	return err
+}
+
+func (store *PostgresStore) PutCosmetic(ctx context.Context, cosmetic StoredCosmetic) error {
+	_, err := store.pool.Exec(ctx, createCosmeticQuery, cosmetic.Id, cosmetic.Version, string(cosmetic.Data))
+	return store.written(constraintError(err))
+}
+
+func (store *PostgresStore) Cosmetic(ctx context.Context, id string) (json.RawMessage, error) {
+	var data []byte
+	err := store.pool.QueryRow(ctx, getCosmeticQuery, id).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (store *PostgresStore) CosmeticsByIds(ctx context.Context, ids []string) ([]interface{}, error) {
+	result, err := store.pool.Query(ctx, getCosmeticsQuery, ids)
+	if err != nil {
+		return nil, err
+	}
+	return collectCosmetics(result)
+}
+
+// collectCosmetics decodes cosmetic definitions, definitions that aren't an object are skipped
+func collectCosmetics(result pgx.Rows) ([]interface{}, error) {
+	defer result.Close()
+	var cosmetics = make([]interface{}, 0)
+	for result.Next() {
+		var cosmetic = make(map[string]interface{})
+		err := result.Scan(&cosmetic)
+		if err != nil {
+			continue
+		}
+		cosmetics = append(cosmetics, cosmetic)
+	}
+	return cosmetics, result.Err()
+}
+
+func (store *PostgresStore) DeleteCosmetic(ctx context.Context, id string) error {
+	result, err := store.pool.Exec(ctx, deleteCosmeticQuery, id)
+	if err == nil && result.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+	return store.written(err)
+}
+
+func (store *PostgresStore) CosmeticIds(ctx context.Context) ([]string, error) {
+	result, err := store.reads.Query(ctx, getCosmeticIdsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(result, pgx.RowTo[string])
+}
+
+func (store *PostgresStore) CreatePlayer(ctx context.Context, id string) (bool, error) {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return false, err
+	}
+	result, err := store.pool.Exec(ctx, createPlayerQuery, id)
+	if err != nil {
+		return false, err
+	}
+	store.reads.Written()
+	return result.RowsAffected() != 0, nil
+}
+
+func (store *PostgresStore) SetPlayerData(ctx context.Context, id string, data json.RawMessage) error {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return err
+	}
+	_, err = store.pool.Exec(ctx, setPlayerDataQuery, id, string(data))
+	return store.written(constraintError(err))
+}
+
+func (store *PostgresStore) PlayerData(ctx context.Context, id string) (json.RawMessage, error) {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return nil, err
+	}
+	result, err := store.reads.Query(ctx, getPlayerDataQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := pgx.CollectOneRow(result, pgx.RowTo[[]byte])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (store *PostgresStore) DeletePlayer(ctx context.Context, id string) error {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return err
+	}
+	result, err := store.pool.Exec(ctx, deletePlayerQuery, id)
+	if err == nil && result.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+	return store.written(err)
+}
+
+func (store *PostgresStore) Player(ctx context.Context, id string) (Player, error) {
+	id, err := parsePlayerId(id)
+	if err != nil {
+		return Player{}, err
+	}
+	result, err := store.reads.Query(ctx, getPlayerQuery, id)
+	if err != nil {
+		return Player{}, err
+	}
+	player, err := pgx.CollectOneRow(result, pgx.RowToStructByPos[Player])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return player, ErrNotFound
+	}
+	return player, err
+}
+
+func (store *PostgresStore) PlayersByIds(ctx context.Context, ids []string) ([]Player, error) {
+	result, err := store.pool.Query(ctx, getPlayersQuery, ids)
+	if err != nil {
+		return nil, constraintError(err)
+	}
+	players, err := pgx.CollectRows(result, pgx.RowToStructByPos[Player])
+	if players == nil {
+		players = make([]Player, 0)
+	}
+	return players, constraintError(err)
+}
+
+func (store *PostgresStore) PlayerIds(ctx context.Context) ([]string, error) {
+	result, err := store.reads.Query(ctx, getPlayerIdsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(result, pgx.RowTo[string])
+}
+
+func (store *PostgresStore) Grant(ctx context.Context, player string, cosmetic string) error {
+	player, err := parsePlayerId(player)
+	if err != nil {
+		return err
+	}
+	result, err := store.pool.Exec(ctx, addGrantQuery, player, cosmetic)
+	if err == nil && result.RowsAffected() != 1 {
+		return ErrAlreadyGranted
+	}
+	return store.written(constraintError(err))
+}
+
+func (store *PostgresStore) Revoke(ctx context.Context, player string, cosmetic string) error {
+	player, err := parsePlayerId(player)
+	if err != nil {
+		return err
+	}
+	result, err := store.pool.Exec(ctx, removeGrantQuery, player, cosmetic)
+	if err == nil && result.RowsAffected() != 1 {
+		return ErrNotFound
+	}
+	return store.written(err)
+}
+
+func (store *PostgresStore) Entries(ctx context.Context) ([]interface{}, []Player, error) {
+	result, err := store.reads.Query(ctx, entriesCosmeticsQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	cosmetics, err := collectCosmetics(result)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err = store.reads.Query(ctx, entriesPlayersQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	players, err := pgx.CollectRows(result, pgx.RowToStructByPos[Player])
+	if err != nil {
+		return nil, nil, err
+	}
+	return cosmetics, players, nil
+}
+
+func readDataset(ctx context.Context, tx pgx.Tx) (Dataset, error) {
+	var dataset Dataset
+	rows, err := tx.Query(ctx, exportCosmeticsQuery)
+	if err == nil {
+		dataset.Cosmetics, err = pgx.CollectRows(rows, pgx.RowToStructByPos[StoredCosmetic])
+	}
+	if err != nil {
+		return dataset, fmt.Errorf("failed to read cosmetics: %w", err)
+	}
+	rows, err = tx.Query(ctx, exportPlayersQuery)
+	if err == nil {
+		dataset.Players, err = pgx.CollectRows(rows, pgx.RowToStructByPos[StoredPlayer])
+	}
+	if err != nil {
+		return dataset, fmt.Errorf("failed to read players: %w", err)
+	}
+	rows, err = tx.Query(ctx, exportGrantsQuery)
+	if err == nil {
+		dataset.Grants, err = pgx.CollectRows(rows, pgx.RowToStructByPos[Grant])
+	}
+	if err != nil {
+		return dataset, fmt.Errorf("failed to read grants: %w", err)
+	}
+	return dataset, nil
+}
+
+// Export reads from a single snapshot of the primary, so the dataset is never behind any change that was already announced
+func (store *PostgresStore) Export(ctx context.Context) (Dataset, uint, error) {
+	tx, err := store.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return Dataset{}, 0, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback(context.Background())
+	dataset, err := readDataset(ctx, tx)
+	if err != nil {
+		return dataset, 0, err
+	}
+	var version int64
+	var dirty bool
+	err = tx.QueryRow(ctx, migrationVersionQuery).Scan(&version, &dirty)
+	if err != nil {
+		return dataset, 0, fmt.Errorf("failed to read migration version: %w", err)
+	}
+	return dataset, uint(version), nil
+}
+
+func (store *PostgresStore) Import(ctx context.Context, dataset Dataset, replace bool, dryRun bool) (Dataset, error) {
+	tx, err := store.pool.Begin(ctx)
+	if err != nil {
+		return Dataset{}, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback(context.Background())
+	if _, err := tx.Exec(ctx, lockDatasetQuery); err != nil {
+		return Dataset{}, err
+	}
+	current, err := readDataset(ctx, tx)
+	if err != nil {
+		return current, err
+	}
+
+	batch := &pgx.Batch{}
+	if replace {
+		cosmetics := make([]string, 0, len(dataset.Cosmetics))
+		for _, cosmetic := range dataset.Cosmetics {
+			cosmetics = append(cosmetics, cosmetic.Id)
+		}
+		players := make([]string, 0, len(dataset.Players))
+		for _, player := range dataset.Players {
+			players = append(players, player.Id)
+		}
+		batch.Queue(deleteGrantsQuery)
+		batch.Queue(deleteOtherCosmeticsQuery, cosmetics)
+		batch.Queue(deleteOtherPlayersQuery, players)
+	}
+	for _, cosmetic := range dataset.Cosmetics {
+		batch.Queue(createCosmeticQuery, cosmetic.Id, cosmetic.Version, string(cosmetic.Data))
+	}
+	for _, player := range dataset.Players {
+		batch.Queue(setPlayerDataQuery, player.Id, string(player.Data))
+	}
+	for _, grant := range dataset.Grants {
+		batch.Queue(addGrantQuery, grant.Player, grant.Cosmetic)
+	}
+	err = tx.SendBatch(ctx, batch).Close()
+	if err != nil {
+		return current, constraintError(err)
+	}
+	if dryRun {
+		return current, nil
+	}
+	return current, store.written(tx.Commit(ctx))
+}
+
+func nullable(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func (store *PostgresStore) RecordChange(ctx context.Context, change Change) error {
+	_, err := store.pool.Exec(ctx, recordChangeQuery, change.Type, nullable(change.Player), nullable(change.Cosmetic))
+	return constraintError(err)
+}
+
+func (store *PostgresStore) ChangesSince(ctx context.Context, id int64, limit int) ([]Change, error) {
+	rows, err := store.pool.Query(ctx, changesSinceQuery, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[Change])
+}
+
+func (store *PostgresStore) LatestChangeId(ctx context.Context) (int64, error) {
+	var id int64
+	err := store.pool.QueryRow(ctx, latestChangeIdQuery).Scan(&id)
+	return id, err
+}
+
+func (store *PostgresStore) OldestChangeId(ctx context.Context) (int64, error) {
+	var id int64
+	err := store.pool.QueryRow(ctx, oldestChangeIdQuery).Scan(&id)
+	return id, err
+}
+
+// PruneChanges counts by id, ids lost to rolled back inserts are counted as well, so slightly fewer changes may be kept
+func (store *PostgresStore) PruneChanges(ctx context.Context, keep int) (int64, error) {
+	tag, err := store.pool.Exec(ctx, pruneChangesQuery, keep)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (store *PostgresStore) Ping(ctx context.Context) error {
+	return store.pool.Ping(ctx)
+}
+
+func (store *PostgresStore) Migrate(_ context.Context) error {
+	m, err := NewMigrate(store.uri)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer m.Close()
+
+	// Apply all migrations up to the latest
+	err = m.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+	return nil
+}
+
+// MigrationVersion reads the version the database was migrated to, it's 0 if no migration ran yet
+func (store *PostgresStore) MigrationVersion(ctx context.Context) (uint, bool, error) {
+	var version int64
+	var dirty bool
+	err := store.pool.QueryRow(ctx, migrationVersionQuery).Scan(&version, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	return uint(version), dirty, err
+}
+
+// Monitor checks the replica until the context is done
+func (store *PostgresStore) Monitor(ctx context.Context) {
+	store.reads.Monitor(ctx, store.checkInterval)
+}
+
+func (store *PostgresStore) Close() {
+	store.reads.Close()
+	store.pool.Close()
+}
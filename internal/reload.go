@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"cosmetics/utils"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// How often the config files are checked for changes, mounted secrets are usually swapped without any event to listen for
+const configPollInterval = 5 * time.Second
+
+// Reloads triggered by a signal and by a file change at the same time are applied one after the other
+var reloads sync.Mutex
+
+// ReloadConfig loads the config again and swaps it in at once, it's rejected as a whole if a setting changed that can't change while running
+func (ctx RouteContext) ReloadConfig(load func() (Config, error), reason string) {
+	reloads.Lock()
+	defer reloads.Unlock()
+
+	next, err := load()
+	if err == nil {
+		var changed []string
+		changed, err = ctx.applyConfig(next)
+		if err == nil {
+			utils.LogData{
+				Message: "Reloaded config after " + reason,
+				Data:    changed,
+			}.Log()
+			return
+		}
+	}
+	utils.LogData{
+		Message: "Rejected config reload after " + reason + ", keeping the current config",
+		Data:    err,
+		Level:   slog.LevelError,
+	}.Log()
+}
+
+func (ctx RouteContext) applyConfig(next Config) ([]string, error) {
+	current := *ctx.Config()
+	currentSettings := settingsOf(&current)
+	var changed []string
+	var errs []error
+	for i, setting := range settingsOf(&next) {
+		if reflect.DeepEqual(setting.value.Interface(), currentSettings[i].value.Interface()) {
+			continue
+		}
+		if !setting.live {
+			errs = append(errs, fmt.Errorf("%s can't change while running, restart to apply it", setting.name))
+			continue
+		}
+		changed = append(changed, setting.name)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	level, err := next.Log.SlogLevel()
+	if err != nil {
+		return nil, err
+	}
+	ctx.config.Store(&next)
+	utils.SetLogLevel(level)
+	return changed, nil
+}
+
+// WatchConfig reloads the config whenever one of the files it was read from changes, until the context is done
+func (ctx RouteContext) WatchConfig(load func() (Config, error)) {
+	files := ctx.Config().files
+	sums := fileSums(files)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Context.Done():
+			return
+		case <-ticker.C:
+		}
+		next := fileSums(files)
+		for _, file := range files {
+			if next[file] != sums[file] {
+				ctx.ReloadConfig(load, "change of "+file)
+				break
+			}
+		}
+		sums = next
+	}
+}
+
+// fileSums hashes the content of the files, a missing file has an empty sum so it's noticed once it appears again
+func fileSums(files []string) map[string][sha256.Size]byte {
+	sums := make(map[string][sha256.Size]byte, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			sums[file] = sha256.Sum256(data)
+		}
+	}
+	return sums
+}
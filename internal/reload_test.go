@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"cosmetics/utils"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newReloadContext(t *testing.T) RouteContext {
+	t.Helper()
+	config := validConfig()
+	config.Storage = StorageMemory
+	t.Cleanup(func() {
+		utils.SetLogLevel(slog.LevelInfo)
+	})
+	ctx, err := NewRouteContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		changed   []string
+		applied   bool
+	}{
+		{"unchanged", func(*Config) {}, nil, true},
+		{"live settings", func(config *Config) {
+			config.ApiToken = "rotated"
+			config.Cache.Ttl = 30
+			config.Log.Level = "debug"
+		}, []string{"api_token", "cache.ttl", "log.level"}, true},
+		{"restart required", func(config *Config) {
+			config.Port = "9000"
+		}, nil, false},
+		{"live and restart required", func(config *Config) {
+			config.ApiToken = "rotated"
+			config.Storage = StoragePostgres
+		}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newReloadContext(t)
+			current := ctx.Config()
+			next := *current
+			test.configure(&next)
+
+			changed, err := ctx.applyConfig(next)
+			if applied := err == nil; applied != test.applied {
+				t.Fatalf("expected the config to be applied %v, got %v", test.applied, err)
+			}
+			if !reflect.DeepEqual(changed, test.changed) {
+				t.Errorf("expected %v to change, got %v", test.changed, changed)
+			}
+			if test.applied && !reflect.DeepEqual(*ctx.Config(), next) {
+				t.Error("expected the new config to be in use")
+			}
+			if !test.applied && ctx.Config() != current {
+				t.Error("expected the current config to be kept")
+			}
+		})
+	}
+}
+
+func TestApplyConfigLogLevel(t *testing.T) {
+	ctx := newReloadContext(t)
+	next := *ctx.Config()
+	next.Log.Level = "debug"
+	if _, err := ctx.applyConfig(next); err != nil {
+		t.Fatal(err)
+	}
+	if !slog.Default().Enabled(ctx.Context, slog.LevelDebug) {
+		t.Error("expected the log level to change with the config")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	ctx := newReloadContext(t)
+	current := ctx.Config()
+
+	ctx.ReloadConfig(func() (Config, error) {
+		return Config{}, errors.New("invalid config")
+	}, "test")
+	if ctx.Config() != current {
+		t.Fatal("expected a failed load to keep the current config")
+	}
+
+	ctx.ReloadConfig(func() (Config, error) {
+		next := *current
+		next.ApiToken = "rotated"
+		return next, nil
+	}, "test")
+	if ctx.Config().ApiToken != "rotated" {
+		t.Error("expected the reloaded config to be in use")
+	}
+}
+
+func TestFileSums(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	missing := filepath.Join(dir, "missing.json")
+	if err := os.WriteFile(file, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before := fileSums([]string{file, missing})
+	if _, ok := before[missing]; ok {
+		t.Error("expected no sum for a missing file")
+	}
+	if err := os.WriteFile(file, []byte(`{"port": "9000"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileSums([]string{file}); after[file] == before[file] {
+		t.Error("expected the sum to change with the content")
+	}
+}
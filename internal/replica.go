@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"cosmetics/utils"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A replica that has replayed everything it received has no lag, even if the primary had no transaction for a while
+const replicaLagQuery = `
+	select coalesce(case
+		when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+		else extract(epoch from now() - pg_last_xact_replay_timestamp())
+	end, 0)::float8
+`
+
+// ReadPool sends public read only queries to the replica if one is configured.
+// It falls back to the primary while the replica is unreachable or too far behind,
+// and for the maximum lag after every write, so a write is always visible to the reads following it.
+type ReadPool struct {
+	primary *pgxpool.Pool
+	replica *pgxpool.Pool
+	maxLag  time.Duration
+
+	healthy   atomic.Bool
+	lastWrite atomic.Int64
+}
+
+func NewReadPool(primary *pgxpool.Pool, replica *pgxpool.Pool, maxLag time.Duration) *ReadPool {
+	return &ReadPool{primary: primary, replica: replica, maxLag: maxLag}
+}
+
+func (pool *ReadPool) current() *pgxpool.Pool {
+	if pool.replica == nil || !pool.healthy.Load() {
+		return pool.primary
+	}
+	if time.Since(time.Unix(0, pool.lastWrite.Load())) < pool.maxLag {
+		return pool.primary
+	}
+	return pool.replica
+}
+
+func (pool *ReadPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	current := pool.current()
+	rows, err := current.Query(ctx, sql, args...)
+	if err != nil && current == pool.replica && IsUnavailable(err) {
+		pool.setHealthy(false, err.Error())
+		return pool.primary.Query(ctx, sql, args...)
+	}
+	return rows, err
+}
+
+// Written keeps reads on the primary until the replica has certainly caught up with the write
+func (pool *ReadPool) Written() {
+	pool.lastWrite.Store(time.Now().UnixNano())
+}
+
+func (pool *ReadPool) setHealthy(healthy bool, reason interface{}) {
+	if pool.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		utils.LogData{Message: "Replica healthy, using it for reads"}.Log()
+	} else {
+		utils.LogData{
+			Message: "Replica unhealthy, reading from primary",
+			Data:    reason,
+			Level:   slog.LevelWarn,
+		}.Log()
+	}
+}
+
+func (pool *ReadPool) checkReplica(ctx context.Context) {
+	var lag float64
+	err := pool.replica.QueryRow(ctx, replicaLagQuery).Scan(&lag)
+	if err != nil {
+		pool.setHealthy(false, err.Error())
+		return
+	}
+	lagDuration := time.Duration(lag * float64(time.Second))
+	if lagDuration > pool.maxLag {
+		pool.setHealthy(false, "Replica is "+lagDuration.String()+" behind")
+		return
+	}
+	pool.setHealthy(true, nil)
+}
+
+// Monitor checks the replica on every interval until the context is done
+func (pool *ReadPool) Monitor(ctx context.Context, interval time.Duration) {
+	if pool.replica == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkContext, cancel := context.WithTimeout(ctx, interval)
+		pool.checkReplica(checkContext)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the replica pool, the primary belongs to the store
+func (pool *ReadPool) Close() {
+	if pool.replica != nil {
+		pool.replica.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// newUnreachablePool creates a pool without connecting, connecting to it later is refused
+func newUnreachablePool(t *testing.T, name string) *pgxpool.Pool {
+	t.Helper()
+	pool, err := pgxpool.New(context.Background(), "postgres://"+name+"@127.0.0.1:1/cosmetics?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestReadPoolCurrent(t *testing.T) {
+	primary := newUnreachablePool(t, "primary")
+	replica := newUnreachablePool(t, "replica")
+	const maxLag = time.Minute
+
+	tests := []struct {
+		name      string
+		replica   *pgxpool.Pool
+		healthy   bool
+		lastWrite time.Duration
+		want      *pgxpool.Pool
+	}{
+		{"no replica", nil, true, 0, primary},
+		{"unhealthy replica", replica, false, 0, primary},
+		{"healthy replica", replica, true, 0, replica},
+		{"recent write", replica, true, time.Second, primary},
+		{"write older than the lag", replica, true, 2 * maxLag, replica},
+	}
+	for _, test := range tests {
+		pool := NewReadPool(primary, test.replica, maxLag)
+		pool.healthy.Store(test.healthy)
+		if test.lastWrite != 0 {
+			pool.lastWrite.Store(time.Now().Add(-test.lastWrite).UnixNano())
+		}
+		if got := pool.current(); got != test.want {
+			t.Errorf("%s: read from the wrong pool", test.name)
+		}
+	}
+}
+
+func TestReadPoolWritten(t *testing.T) {
+	primary := newUnreachablePool(t, "primary")
+	replica := newUnreachablePool(t, "replica")
+	pool := NewReadPool(primary, replica, time.Minute)
+	pool.healthy.Store(true)
+
+	pool.Written()
+	if pool.current() != primary {
+		t.Error("expected reads right after a write to go to the primary")
+	}
+}
+
+func TestReadPoolFallback(t *testing.T) {
+	primary := newUnreachablePool(t, "primary")
+	replica := newUnreachablePool(t, "replica")
+	pool := NewReadPool(primary, replica, time.Minute)
+	pool.healthy.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := pool.Query(ctx, "select 1")
+	if err == nil || !IsUnavailable(err) {
+		t.Fatalf("expected the primary to be unreachable as well, got %v", err)
+	}
+	if pool.healthy.Load() {
+		t.Error("expected an unreachable replica to be marked unhealthy")
+	}
+
+	pool.healthy.Store(true)
+	pool.checkReplica(ctx)
+	if pool.healthy.Load() {
+		t.Error("expected a failed check to mark the replica unhealthy")
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+const (
+	StoragePostgres = "postgres"
+	// Keeps everything in the memory of the process, for running locally and in tests without a database
+	StorageMemory = "memory"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// The entry breaks a constraint of the schema, like an invalid id, version or json
+	ErrInvalid         = errors.New("invalid entry")
+	ErrUnknownCosmetic = errors.New("no matching cosmetic found")
+	ErrAlreadyGranted  = errors.New("already granted")
+)
+
+// Player is a player with the ids of its cosmetics, the way the api returns it
+type Player struct {
+	Player    string                 `json:"uuid"`
+	Data      map[string]interface{} `json:"extra_data"`
+	Cosmetics []string               `json:"cosmetics"`
+}
+
+// StoredCosmetic, StoredPlayer and Grant are the entries as they are stored, with the data kept as it was written
+type StoredCosmetic struct {
+	Id      string          `json:"id"`
+	Version *int            `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type StoredPlayer struct {
+	Id   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+type Grant struct {
+	Player   string `json:"player"`
+	Cosmetic string `json:"cosmetic"`
+}
+
+// Dataset is everything stored, the entries as they are, sorted by id.
+// The change log isn't part of it, it's the history of one deployment and means nothing to another one.
+type Dataset struct {
+	Cosmetics []StoredCosmetic
+	Players   []StoredPlayer
+	Grants    []Grant
+}
+
+// Store keeps the cosmetics, players, their grants and the change log. Every implementation has the semantics of the Postgres schema:
+// player ids are uuids, granting needs both the player and the cosmetic and deleting either of them removes its grants.
+// Single entries that don't exist are reported with ErrNotFound, entries breaking the schema with ErrInvalid.
+type Store interface {
+	PutCosmetic(ctx context.Context, cosmetic StoredCosmetic) error
+	Cosmetic(ctx context.Context, id string) (json.RawMessage, error)
+	// CosmeticsByIds leaves out unknown ids
+	CosmeticsByIds(ctx context.Context, ids []string) ([]interface{}, error)
+	DeleteCosmetic(ctx context.Context, id string) error
+	CosmeticIds(ctx context.Context) ([]string, error)
+
+	// CreatePlayer creates a player with empty data, it reports whether the player didn't exist before
+	CreatePlayer(ctx context.Context, id string) (bool, error)
+	// SetPlayerData creates the player if needed
+	SetPlayerData(ctx context.Context, id string, data json.RawMessage) error
+	PlayerData(ctx context.Context, id string) (json.RawMessage, error)
+	DeletePlayer(ctx context.Context, id string) error
+	Player(ctx context.Context, id string) (Player, error)
+	// PlayersByIds leaves out unknown ids
+	PlayersByIds(ctx context.Context, ids []string) ([]Player, error)
+	PlayerIds(ctx context.Context) ([]string, error)
+
+	// Grant fails with ErrNotFound for an unknown player, ErrUnknownCosmetic for an unknown cosmetic and ErrAlreadyGranted
+	Grant(ctx context.Context, player string, cosmetic string) error
+	Revoke(ctx context.Context, player string, cosmetic string) error
+
+	// Entries reads every cosmetic and player for the public entries, it may come from a replica
+	Entries(ctx context.Context) ([]interface{}, []Player, error)
+	// Export reads the whole dataset from a single consistent state, along with the migration version of its schema
+	Export(ctx context.Context) (Dataset, uint, error)
+	// Import applies a dataset at once and returns the dataset as it was right before, replacing deletes everything not part of it.
+	// A dry run is rolled back, but fails on everything the import would fail on.
+	Import(ctx context.Context, dataset Dataset, replace bool, dryRun bool) (Dataset, error)
+
+	// RecordChange appends to the change log, which tells every instance about the change through its change listener
+	RecordChange(ctx context.Context, change Change) error
+	// ChangesSince returns at most limit changes after the given id, oldest first
+	ChangesSince(ctx context.Context, id int64, limit int) ([]Change, error)
+	LatestChangeId(ctx context.Context) (int64, error)
+	// OldestChangeId is the first change still in the log, everything before it was pruned. It's 0 for an empty log.
+	OldestChangeId(ctx context.Context) (int64, error)
+	// PruneChanges removes all but the latest keep changes and returns how many were removed
+	PruneChanges(ctx context.Context, keep int) (int64, error)
+
+	Ping(ctx context.Context) error
+	// Migrate brings the schema up to date
+	Migrate(ctx context.Context) error
+	MigrationVersion(ctx context.Context) (uint, bool, error)
+	// Monitor runs the background checks of the store until the context is done
+	Monitor(ctx context.Context)
+	Close()
+}
+
+// parsePlayerId brings a player id into the form the database returns it in
+func parsePlayerId(id string) (string, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("%w: player id %q", ErrInvalid, id)
+	}
+	return parsed.String(), nil
+}
+
+// isStoreError reports whether the store rejected an operation, which means it was reachable
+func isStoreError(err error) bool {
+	for _, target := range []error{ErrNotFound, ErrInvalid, ErrUnknownCosmetic, ErrAlreadyGranted} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
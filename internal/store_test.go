@@ -0,0 +1,405 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const (
+	testPlayer      = "0f6a4e0c-8d5b-4a3e-9f4e-2b1c6d7e8f90"
+	testOtherPlayer = "5d2b7c1a-3e4f-4a6b-8c9d-0e1f2a3b4c5d"
+)
+
+// TestMemoryStore and TestPostgresStore run the same contract, so the memory store keeps the semantics of the schema
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func() Store {
+		return NewMemoryStore(NewChangeListener(nil))
+	})
+}
+
+// TestPostgresStore needs a database it may wipe, given as COSMETICS_TEST_POSTGRES_URI
+func TestPostgresStore(t *testing.T) {
+	uri := os.Getenv("COSMETICS_TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("COSMETICS_TEST_POSTGRES_URI is not set")
+	}
+	config := defaultConfig()
+	config.PostgresUri = uri
+	// The pool metrics can only be registered once, so every case shares the store
+	store, err := NewPostgresStore(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	testStore(t, func() Store {
+		return store
+	})
+}
+
+// testStore runs every case against a migrated store emptied by an import
+func testStore(t *testing.T, open func() Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, store Store)
+	}{
+		{"cosmetics", testStoreCosmetics},
+		{"players", testStorePlayers},
+		{"grants", testStoreGrants},
+		{"import", testStoreImport},
+		{"change log", testStoreChangeLog},
+		{"concurrent changes", testStoreConcurrentChanges},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open()
+			if err := store.Migrate(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Import(ctx, Dataset{}, true, false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.PruneChanges(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+			test.test(t, ctx, store)
+		})
+	}
+}
+
+func expectError(t *testing.T, name string, err error, expected error) {
+	t.Helper()
+	if expected == nil && err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if !errors.Is(err, expected) {
+		t.Fatalf("%s: expected %v, got %v", name, expected, err)
+	}
+}
+
+// expectJson compares json by its values, the database doesn't have to keep the formatting
+func expectJson(t *testing.T, name string, data []byte, expected string) {
+	t.Helper()
+	var actual, wanted interface{}
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err := json.Unmarshal([]byte(expected), &wanted); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, wanted) {
+		t.Fatalf("%s: expected %s, got %s", name, expected, data)
+	}
+}
+
+// expectIds ignores the order, the database doesn't sort the ids
+func expectIds(t *testing.T, name string, ids []string, err error, expected ...string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	ids = slices.Sorted(slices.Values(ids))
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("%s: expected %v, got %v", name, expected, ids)
+	}
+}
+
+func putCosmetic(t *testing.T, ctx context.Context, store Store, id string, version int) {
+	t.Helper()
+	err := store.PutCosmetic(ctx, StoredCosmetic{Id: id, Version: &version, Data: json.RawMessage(`{"id": "` + id + `"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStoreCosmetics(t *testing.T, ctx context.Context, store Store) {
+	version := 1
+	putCosmetic(t, ctx, store, "hat", 1)
+	putCosmetic(t, ctx, store, "cape", 1)
+	ids, err := store.CosmeticIds(ctx)
+	expectIds(t, "ids", ids, err, "cape", "hat")
+
+	err = store.PutCosmetic(ctx, StoredCosmetic{Id: "hat", Version: &version, Data: json.RawMessage(`{"id": "hat", "color": "red"}`)})
+	expectError(t, "update", err, nil)
+	data, err := store.Cosmetic(ctx, "hat")
+	expectError(t, "read", err, nil)
+	expectJson(t, "read", data, `{"id": "hat", "color": "red"}`)
+
+	cosmetics, err := store.CosmeticsByIds(ctx, []string{"cape", "unknown"})
+	expectError(t, "by ids", err, nil)
+	if len(cosmetics) != 1 {
+		t.Fatalf("by ids: expected only the known cosmetic, got %v", cosmetics)
+	}
+
+	invalid := -1
+	expectError(t, "invalid id", store.PutCosmetic(ctx, StoredCosmetic{Id: "Not Valid", Version: &version, Data: json.RawMessage(`{}`)}), ErrInvalid)
+	expectError(t, "invalid version", store.PutCosmetic(ctx, StoredCosmetic{Id: "hat", Version: &invalid, Data: json.RawMessage(`{}`)}), ErrInvalid)
+
+	expectError(t, "delete", store.DeleteCosmetic(ctx, "cape"), nil)
+	expectError(t, "delete again", store.DeleteCosmetic(ctx, "cape"), ErrNotFound)
+	_, err = store.Cosmetic(ctx, "cape")
+	expectError(t, "read deleted", err, ErrNotFound)
+}
+
+func testStorePlayers(t *testing.T, ctx context.Context, store Store) {
+	created, err := store.CreatePlayer(ctx, testPlayer)
+	expectError(t, "create", err, nil)
+	if !created {
+		t.Fatal("create: expected a new player")
+	}
+	created, err = store.CreatePlayer(ctx, testPlayer)
+	expectError(t, "create again", err, nil)
+	if created {
+		t.Fatal("create again: expected the existing player")
+	}
+	data, err := store.PlayerData(ctx, testPlayer)
+	expectError(t, "empty data", err, nil)
+	expectJson(t, "empty data", data, `{}`)
+
+	expectError(t, "set data", store.SetPlayerData(ctx, testOtherPlayer, json.RawMessage(`{"name": "other"}`)), nil)
+	data, err = store.PlayerData(ctx, testOtherPlayer)
+	expectError(t, "data", err, nil)
+	expectJson(t, "data", data, `{"name": "other"}`)
+	ids, err := store.PlayerIds(ctx)
+	expectIds(t, "ids", ids, err, testPlayer, testOtherPlayer)
+
+	players, err := store.PlayersByIds(ctx, []string{testOtherPlayer, "7c0e3b9a-1d2f-4e5a-8b6c-9d0e1f2a3b4c"})
+	expectError(t, "by ids", err, nil)
+	if len(players) != 1 || players[0].Player != testOtherPlayer || players[0].Data["name"] != "other" {
+		t.Fatalf("by ids: expected only the known player, got %v", players)
+	}
+
+	_, err = store.Player(ctx, "not-a-uuid")
+	expectError(t, "invalid id", err, ErrInvalid)
+	expectError(t, "delete", store.DeletePlayer(ctx, testPlayer), nil)
+	expectError(t, "delete again", store.DeletePlayer(ctx, testPlayer), ErrNotFound)
+	_, err = store.Player(ctx, testPlayer)
+	expectError(t, "read deleted", err, ErrNotFound)
+	_, err = store.PlayerData(ctx, testPlayer)
+	expectError(t, "read deleted data", err, ErrNotFound)
+}
+
+func testStoreGrants(t *testing.T, ctx context.Context, store Store) {
+	putCosmetic(t, ctx, store, "hat", 1)
+	putCosmetic(t, ctx, store, "cape", 1)
+	expectError(t, "unknown player", store.Grant(ctx, testPlayer, "hat"), ErrNotFound)
+	_, err := store.CreatePlayer(ctx, testPlayer)
+	expectError(t, "create", err, nil)
+
+	expectError(t, "grant", store.Grant(ctx, testPlayer, "hat"), nil)
+	expectError(t, "grant", store.Grant(ctx, testPlayer, "cape"), nil)
+	expectError(t, "grant again", store.Grant(ctx, testPlayer, "hat"), ErrAlreadyGranted)
+	expectError(t, "unknown cosmetic", store.Grant(ctx, testPlayer, "unknown"), ErrUnknownCosmetic)
+	player, err := store.Player(ctx, testPlayer)
+	expectIds(t, "granted", player.Cosmetics, err, "cape", "hat")
+
+	expectError(t, "revoke", store.Revoke(ctx, testPlayer, "hat"), nil)
+	expectError(t, "revoke again", store.Revoke(ctx, testPlayer, "hat"), ErrNotFound)
+	// Deleting a cosmetic takes its grants along, granting it after creating it again starts over
+	expectError(t, "delete", store.DeleteCosmetic(ctx, "cape"), nil)
+	player, err = store.Player(ctx, testPlayer)
+	expectIds(t, "after delete", player.Cosmetics, err)
+	putCosmetic(t, ctx, store, "cape", 1)
+	expectError(t, "grant recreated", store.Grant(ctx, testPlayer, "cape"), nil)
+
+	expectError(t, "delete player", store.DeletePlayer(ctx, testPlayer), nil)
+	dataset, _, err := store.Export(ctx)
+	expectError(t, "export", err, nil)
+	if len(dataset.Grants) != 0 {
+		t.Fatalf("expected the grants of the deleted player to be gone, got %v", dataset.Grants)
+	}
+}
+
+func testStoreImport(t *testing.T, ctx context.Context, store Store) {
+	version := 1
+	putCosmetic(t, ctx, store, "hat", 1)
+	_, err := store.CreatePlayer(ctx, testPlayer)
+	expectError(t, "create", err, nil)
+	expectError(t, "grant", store.Grant(ctx, testPlayer, "hat"), nil)
+	before, _, err := store.Export(ctx)
+	expectError(t, "export", err, nil)
+
+	dataset := Dataset{
+		Cosmetics: []StoredCosmetic{{Id: "cape", Version: &version, Data: json.RawMessage(`{"id": "cape"}`)}},
+		Players:   []StoredPlayer{{Id: testOtherPlayer, Data: json.RawMessage(`{"name": "other"}`)}},
+		Grants:    []Grant{{Player: testOtherPlayer, Cosmetic: "cape"}},
+	}
+	previous, err := store.Import(ctx, dataset, false, true)
+	expectError(t, "dry run", err, nil)
+	expectDataset(t, "dry run returns the current dataset", previous, before)
+	after, _, err := store.Export(ctx)
+	expectError(t, "export after dry run", err, nil)
+	expectDataset(t, "dry run changes nothing", after, before)
+
+	_, err = store.Import(ctx, dataset, false, false)
+	expectError(t, "merge", err, nil)
+	ids, err := store.CosmeticIds(ctx)
+	expectIds(t, "merged cosmetics", ids, err, "cape", "hat")
+	ids, err = store.PlayerIds(ctx)
+	expectIds(t, "merged players", ids, err, testPlayer, testOtherPlayer)
+
+	_, err = store.Import(ctx, dataset, true, false)
+	expectError(t, "replace", err, nil)
+	after, _, err = store.Export(ctx)
+	expectError(t, "export after replace", err, nil)
+	expectDataset(t, "replace keeps only the dataset", after, dataset)
+
+	broken := Dataset{Grants: []Grant{{Player: testOtherPlayer, Cosmetic: "unknown"}}}
+	_, err = store.Import(ctx, broken, true, false)
+	if err == nil {
+		t.Fatal("expected an import with an unknown cosmetic to fail")
+	}
+	after, _, err = store.Export(ctx)
+	expectError(t, "export after failure", err, nil)
+	expectDataset(t, "a failed import changes nothing", after, dataset)
+}
+
+// expectDataset compares the data of the entries as json, the rest has to match exactly
+func expectDataset(t *testing.T, name string, actual Dataset, expected Dataset) {
+	t.Helper()
+	if len(actual.Cosmetics) != len(expected.Cosmetics) || len(actual.Players) != len(expected.Players) ||
+		!slices.Equal(actual.Grants, expected.Grants) {
+		t.Fatalf("%s: expected %+v, got %+v", name, expected, actual)
+	}
+	for i, cosmetic := range actual.Cosmetics {
+		if cosmetic.Id != expected.Cosmetics[i].Id || *cosmetic.Version != *expected.Cosmetics[i].Version {
+			t.Fatalf("%s: expected cosmetic %+v, got %+v", name, expected.Cosmetics[i], cosmetic)
+		}
+		expectJson(t, name, cosmetic.Data, string(expected.Cosmetics[i].Data))
+	}
+	for i, player := range actual.Players {
+		if player.Id != expected.Players[i].Id {
+			t.Fatalf("%s: expected player %s, got %s", name, expected.Players[i].Id, player.Id)
+		}
+		expectJson(t, name, player.Data, string(expected.Players[i].Data))
+	}
+}
+
+func testStoreChangeLog(t *testing.T, ctx context.Context, store Store) {
+	oldest, err := store.OldestChangeId(ctx)
+	expectError(t, "oldest of an empty log", err, nil)
+	if oldest != 0 {
+		t.Fatalf("expected 0 for an empty log, got %d", oldest)
+	}
+	// Ids keep counting after a prune, so they are compared relative to the latest one
+	start, err := store.LatestChangeId(ctx)
+	expectError(t, "latest", err, nil)
+
+	changes := []Change{
+		{Type: "cosmetic", Cosmetic: "hat"},
+		{Type: "player", Player: testPlayer},
+		{Type: "grant", Player: testPlayer, Cosmetic: "hat"},
+	}
+	for _, change := range changes {
+		expectError(t, "record", store.RecordChange(ctx, change), nil)
+	}
+	latest, err := store.LatestChangeId(ctx)
+	expectError(t, "latest", err, nil)
+	if latest != start+3 {
+		t.Fatalf("expected latest id %d, got %d", start+3, latest)
+	}
+
+	since, err := store.ChangesSince(ctx, start, 2)
+	expectError(t, "since", err, nil)
+	for i := range changes {
+		changes[i].Id = start + int64(i) + 1
+	}
+	if !slices.Equal(since, changes[:2]) {
+		t.Fatalf("expected %v, got %v", changes[:2], since)
+	}
+	since, err = store.ChangesSince(ctx, latest, 10)
+	expectError(t, "since latest", err, nil)
+	if len(since) != 0 {
+		t.Fatalf("expected no changes after the latest one, got %v", since)
+	}
+
+	pruned, err := store.PruneChanges(ctx, 1)
+	expectError(t, "prune", err, nil)
+	if pruned != 2 {
+		t.Fatalf("expected 2 pruned changes, got %d", pruned)
+	}
+	oldest, err = store.OldestChangeId(ctx)
+	expectError(t, "oldest", err, nil)
+	if oldest != latest {
+		t.Fatalf("expected oldest id %d, got %d", latest, oldest)
+	}
+	expectError(t, "invalid player", store.RecordChange(ctx, Change{Type: "player", Player: "not-a-uuid"}), ErrInvalid)
+}
+
+const concurrentChanges = 50
+
+// recordConcurrently records concurrentChanges changes at once, one per cosmetic named after its index
+func recordConcurrently(t *testing.T, ctx context.Context, store Store) {
+	t.Helper()
+	var group sync.WaitGroup
+	errs := make(chan error, concurrentChanges)
+	for i := range concurrentChanges {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			errs <- store.RecordChange(ctx, Change{Type: "cosmetic", Cosmetic: strconv.Itoa(i)})
+		}()
+	}
+	group.Wait()
+	close(errs)
+	for err := range errs {
+		expectError(t, "record", err, nil)
+	}
+}
+
+func testStoreConcurrentChanges(t *testing.T, ctx context.Context, store Store) {
+	start, err := store.LatestChangeId(ctx)
+	expectError(t, "latest", err, nil)
+	recordConcurrently(t, ctx, store)
+
+	latest, err := store.LatestChangeId(ctx)
+	expectError(t, "latest", err, nil)
+	if latest != start+concurrentChanges {
+		t.Fatalf("expected latest id %d, got %d", start+concurrentChanges, latest)
+	}
+	since, err := store.ChangesSince(ctx, start, concurrentChanges+1)
+	expectError(t, "since", err, nil)
+	if len(since) != concurrentChanges {
+		t.Fatalf("expected %d changes, got %d", concurrentChanges, len(since))
+	}
+	cosmetics := map[string]bool{}
+	for i, change := range since {
+		if change.Id != start+int64(i)+1 {
+			t.Fatalf("expected id %d at %d, got %d", start+int64(i)+1, i, change.Id)
+		}
+		cosmetics[change.Cosmetic] = true
+	}
+	if len(cosmetics) != concurrentChanges {
+		t.Fatalf("expected every change once, got %v", since)
+	}
+}
+
+// Postgres notifies in commit order, which the event streams make up for, but the memory store notifies in id order
+func TestMemoryStoreNotifiesInOrder(t *testing.T) {
+	changes := NewChangeListener(nil)
+	store := NewMemoryStore(changes)
+	ctx := context.Background()
+
+	var notified []int64
+	changes.OnChange(func(change Change) {
+		// No lock needed if the handlers are never called concurrently, which the race detector checks
+		notified = append(notified, change.Id)
+	})
+	recordConcurrently(t, ctx, store)
+
+	if len(notified) != concurrentChanges {
+		t.Fatalf("expected %d notifications, got %d", concurrentChanges, len(notified))
+	}
+	for i, id := range notified {
+		if id != int64(i)+1 {
+			t.Fatalf("expected id %d notified at %d, got %v", i+1, i, notified)
+		}
+	}
+}
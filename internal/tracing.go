@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"cosmetics/utils"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TracingDisabled = "none"
+	TracingStdout   = "stdout"
+	TracingOtlp     = "otlp"
+)
+
+const tracerName = "cosmetics"
+
+// SetupTracing installs the configured exporter, trace context headers are propagated even while tracing is disabled.
+// The returned function flushes the remaining spans.
+func SetupTracing(conf TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case TracingStdout:
+		// Standard output carries the logs, which log shippers read line by line, so the indented spans go elsewhere
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case TracingOtlp:
+		var options []otlptracehttp.Option
+		if conf.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(conf.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", conf.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(service),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// TraceRequests starts a server span for every request, continuing the trace of the caller if it sent a traceparent header.
+// The span is named after the route pattern the mux is going to pick, the path would make every span name unique.
+func TraceRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	tracer := otel.Tracer(tracerName)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		_, route := mux.Handler(req)
+		name := req.Method
+		if route != "" {
+			name += " " + route
+		}
+
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("user_agent.original", req.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		recorder := utils.NewStatusRecorder(res)
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+
+		status := recorder.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	})
+}
+
+// queryTracer adds a child span for every query, so a slow request shows which query it waited for
+type queryTracer struct {
+	tracer trace.Tracer
+}
+
+func newQueryTracer() queryTracer {
+	return queryTracer{otel.Tracer(tracerName)}
+}
+
+func (tracer queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	statement := strings.Join(strings.Fields(data.SQL), " ")
+	name := statement
+	if operation, _, found := strings.Cut(statement, " "); found {
+		name = strings.ToLower(operation)
+	}
+	ctx, _ = tracer.tracer.Start(ctx, "db "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "postgresql"),
+			attribute.String("db.query.text", statement),
+		),
+	)
+	return ctx
+}
+
+func (tracer queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+	if data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows) {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+		return
+	}
+	span.SetAttributes(attribute.Int64("db.response.affected_rows", data.CommandTag.RowsAffected()))
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// resetTracing puts back a provider that records nothing once the test is done
+func resetTracing(t *testing.T) {
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+}
+
+func TestSetupTracing(t *testing.T) {
+	tests := []struct {
+		conf     TracingConfig
+		exported bool
+	}{
+		{TracingConfig{Exporter: TracingDisabled}, false},
+		{TracingConfig{Exporter: TracingStdout, ServiceName: "cosmetics", SampleRatio: 1}, true},
+		{TracingConfig{Exporter: TracingOtlp, Endpoint: "http://127.0.0.1:1/v1/traces", ServiceName: "cosmetics", SampleRatio: 1}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.conf.Exporter, func(t *testing.T) {
+			resetTracing(t)
+			otel.SetTracerProvider(noop.NewTracerProvider())
+			flush, err := SetupTracing(test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, exported := otel.GetTracerProvider().(*sdktrace.TracerProvider); exported != test.exported {
+				t.Errorf("expected an exporting provider to be %v", test.exported)
+			}
+			if err := flush(context.Background()); err != nil {
+				t.Errorf("failed to flush without spans: %v", err)
+			}
+			if otel.GetTextMapPropagator().Fields() == nil {
+				t.Error("expected the trace context to be propagated")
+			}
+		})
+	}
+}
+
+// captureOutput replaces standard output and error with files until the test is done
+func captureOutput(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	stdout, stderr := os.Stdout, os.Stderr
+	t.Cleanup(func() {
+		os.Stdout, os.Stderr = stdout, stderr
+	})
+	var err error
+	os.Stdout, err = os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err == nil {
+		os.Stderr, err = os.Create(filepath.Join(t.TempDir(), "stderr"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.Stdout, os.Stderr
+}
+
+func TestStdoutTracingLeavesLogsAlone(t *testing.T) {
+	resetTracing(t)
+	stdout, stderr := captureOutput(t)
+	flush, err := SetupTracing(TracingConfig{Exporter: TracingStdout, ServiceName: "cosmetics", SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer(tracerName).Start(context.Background(), "test span")
+	span.End()
+	if err := flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 0 || !strings.Contains(string(spans), "test span") {
+		t.Errorf("expected the spans on standard error only, got %q on standard output", logs)
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	resetTracing(t)
+	_, _ = SetupTracing(TracingConfig{Exporter: TracingDisabled})
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/players/{uuid}", func(res http.ResponseWriter, req *http.Request) {
+		if !trace.SpanContextFromContext(req.Context()).IsValid() {
+			t.Error("expected the handler to run within the span")
+		}
+		if req.PathValue("uuid") == "broken" {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	handler := TraceRequests(mux, mux)
+
+	const parent = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name   string
+		path   string
+		parent string
+		span   string
+		status int
+	}{
+		{"route", "/players/abc", "", "GET /players/{uuid}", http.StatusOK},
+		{"continued trace", "/players/abc", parent, "GET /players/{uuid}", http.StatusOK},
+		{"server error", "/players/broken", "", "GET /players/{uuid}", http.StatusInternalServerError},
+		{"unmatched", "/unknown", "", "GET", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder.Reset()
+			req := httptest.NewRequest("GET", test.path, nil)
+			if test.parent != "" {
+				req.Header.Set("traceparent", "00-"+test.parent+"-00f067aa0ba902b7-01")
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := recorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+			span := spans[0]
+			if span.Name() != test.span || span.SpanKind() != trace.SpanKindServer {
+				t.Errorf("unexpected span %q of kind %v", span.Name(), span.SpanKind())
+			}
+			if test.parent != "" && span.SpanContext().TraceID().String() != test.parent {
+				t.Errorf("expected the trace %s to be continued, got %s", test.parent, span.SpanContext().TraceID())
+			}
+			var status attribute.Value
+			for _, attr := range span.Attributes() {
+				if attr.Key == "http.response.status_code" {
+					status = attr.Value
+				}
+			}
+			if status.AsInt64() != int64(test.status) {
+				t.Errorf("expected status attribute %d, got %v", test.status, status.Emit())
+			}
+			if failed := span.Status().Code == codes.Error; failed != (test.status >= http.StatusInternalServerError) {
+				t.Errorf("unexpected span status %+v", span.Status())
+			}
+		})
+	}
+}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"context"
 	"cosmetics/internal"
 	"cosmetics/routes"
+	"cosmetics/utils"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func setDefaults(route *RequestRoute) {
@@ -55,22 +68,33 @@ type AuthenticatedRequestHandler struct {
 	handler func(internal.RouteContext, http.ResponseWriter, *http.Request)
 }
 
-var routeContext = internal.NewRouteContext()
+var routeContext internal.RouteContext
 
 func (not NotImplementedRequestHandler) handle(res http.ResponseWriter, _ *http.Request) {
 	res.WriteHeader(http.StatusMethodNotAllowed)
 }
 
+// setActor records who a request acts for, so it's part of every line logged for the request
+func setActor(req *http.Request, actor string) {
+	if info, ok := utils.GetRequestInfo(req.Context()); ok {
+		info.SetActor(actor)
+	}
+}
+
 func (normal RequestHandler) handle(res http.ResponseWriter, req *http.Request) {
-	normal.handler(routeContext, res, req)
+	if player := req.PathValue("uuid"); player != "" {
+		setActor(req, "player:"+player)
+	}
+	normal.handler(routeContext.ForRequest(req), res, req)
 }
 
 func (authenticated AuthenticatedRequestHandler) handle(res http.ResponseWriter, req *http.Request) {
-	if !internal.IsAuthenticated(req.Header.Get("Authorization")) {
+	if !routeContext.Config().IsAuthenticated(req.Header.Get("Authorization")) {
 		res.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	authenticated.handler(routeContext, res, req)
+	setActor(req, "api_token")
+	authenticated.handler(routeContext.ForRequest(req), res, req)
 }
 
 func create(handlers RequestRoute) func(http.ResponseWriter, *http.Request) {
@@ -102,6 +126,72 @@ func createSave(path string, handlers RequestRoute) func(http.ResponseWriter, *h
 }
 
 func main() {
+	args := os.Args[1:]
+	// Without a command the server is started, like before there were commands
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serve(args)
+		return
+	}
+	runCommand(args[0], args[1:])
+}
+
+// parseConfig reads the config of the server from the arguments, the environment and the config files, it's called again on every reload
+func parseConfig(args []string) (internal.Config, bool, error) {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	printConfig := flags.Bool("print-config", false, "Print the effective config with secrets redacted and exit")
+	conf, err := internal.LoadConfig(flags, args)
+	if err == nil && flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	return conf, *printConfig, err
+}
+
+func serve(args []string) {
+	reloadConfig := func() (internal.Config, error) {
+		conf, _, err := parseConfig(args)
+		return conf, err
+	}
+	conf, printConfig, err := parseConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid config:\n%v\n", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(conf.Redacted())
+		return
+	}
+
+	level, _ := conf.Log.SlogLevel()
+	utils.SetupLogging(os.Stdout, conf.Log.Format, level)
+	utils.LogData{
+		Message: "Loaded config",
+		Data:    conf.Redacted(),
+	}.Log()
+	conf.LogWarnings()
+	routeContext, err = internal.NewRouteContext(conf)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to set up storage",
+			Data:    err,
+			Level:   slog.LevelError,
+		}.Log()
+		os.Exit(1)
+	}
+	flushTraces, err := internal.SetupTracing(routeContext.Config().Tracing)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to set up tracing",
+			Data:    err,
+			Level:   slog.LevelError,
+		}.Log()
+		os.Exit(1)
+	}
+
 	http.HandleFunc("/cosmetics/{cosmetic_id}", create(RequestRoute{
 		Post:   authenticated(routes.CreateOrUpdateCosmetic),
 		Delete: authenticated(routes.DeleteCosmetic),
@@ -113,9 +203,51 @@ func main() {
 	http.HandleFunc("/", createSave("/", RequestRoute{
 		Get: public(routes.GetEntries),
 	}))
+	http.HandleFunc("/admin/export", create(RequestRoute{
+		Get: authenticated(routes.ExportDataset),
+	}))
+	http.HandleFunc("/admin/import", create(RequestRoute{
+		Post: authenticated(routes.ImportDataset),
+	}))
+	http.HandleFunc("/cache/stats", create(RequestRoute{
+		Get: authenticated(routes.GetCacheStats),
+	}))
+	http.HandleFunc("/health", create(RequestRoute{
+		Get: public(routes.GetHealth),
+	}))
+	http.HandleFunc("/healthz", create(RequestRoute{
+		Get: public(routes.GetLiveness),
+	}))
+	http.HandleFunc("/readyz", create(RequestRoute{
+		Get: public(routes.GetReadiness),
+	}))
+	http.HandleFunc("/events", create(RequestRoute{
+		Get: public(routes.StreamEvents),
+	}))
+	http.HandleFunc("/subscribe", create(RequestRoute{
+		Get: public(routes.SubscribePlayers),
+	}))
+	http.HandleFunc("/shards", create(RequestRoute{
+		Get: public(routes.GetShardManifest),
+	}))
+	http.HandleFunc("/shards/cosmetics", create(RequestRoute{
+		Get: public(routes.GetCosmeticsShard),
+	}))
+	http.HandleFunc("/shards/{prefix}", create(RequestRoute{
+		Get: public(routes.GetShard),
+	}))
+	http.HandleFunc("/snapshots/key", create(RequestRoute{
+		Get: public(routes.GetSnapshotKey),
+	}))
 	http.HandleFunc("/players", create(RequestRoute{
 		Get: public(routes.ListPlayerIds),
 	}))
+	http.HandleFunc("/players/batch", create(RequestRoute{
+		Post: public(routes.GetPlayersBatch),
+	}))
+	http.HandleFunc("/players/filter", create(RequestRoute{
+		Get: public(routes.GetPlayerFilter),
+	}))
 	http.HandleFunc("/players/{uuid}", create(RequestRoute{
 		Get:    public(routes.GetPlayerData),
 		Delete: authenticated(routes.DeletePlayer),
@@ -129,10 +261,226 @@ func main() {
 		Delete: public(routes.RemovePlayerCosmetic),
 	}))
 
-	fmt.Printf("Listening on 0.0.0.0:%s\n", routeContext.Config.Port)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", routeContext.Config.Port), nil)
+	// Served on the admin listener instead if there is one, so scrapes don't need the api token
+	admin := http.NewServeMux()
+	if routeContext.Config().Admin.Enabled() {
+		admin.HandleFunc("/metrics", create(RequestRoute{
+			Get: public(routes.GetMetrics),
+		}))
+		admin.HandleFunc("/healthz", create(RequestRoute{
+			Get: public(routes.GetLiveness),
+		}))
+		admin.HandleFunc("/readyz", create(RequestRoute{
+			Get: public(routes.GetReadiness),
+		}))
+	} else {
+		http.HandleFunc("/metrics", create(RequestRoute{
+			Get: authenticated(routes.GetMetrics),
+		}))
+	}
+
+	routeContext.Changes.OnChange(func(internal.Change) {
+		routes.InvalidateEntries()
+	})
+	routeContext.Changes.OnReconnect(routes.InvalidateEntries)
+
+	// Background jobs run on their own context, so they are only stopped once the in-flight requests are done
+	jobs, stopJobs := context.WithCancel(routeContext.Context)
+	jobContext := routeContext
+	jobContext.Context = jobs
+	var running sync.WaitGroup
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		startup(jobContext, &running)
+	}()
+	running.Add(2)
+	go func() {
+		defer running.Done()
+		jobContext.WatchConfig(reloadConfig)
+	}()
+	go func() {
+		defer running.Done()
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		for {
+			select {
+			case <-jobs.Done():
+				return
+			case <-reload:
+				jobContext.ReloadConfig(reloadConfig, "SIGHUP")
+			}
+		}
+	}()
+
+	streams, stopStreams := context.WithCancel(context.Background())
+	config := routeContext.Config().Server
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%s", routeContext.Config().Port),
+		ReadHeaderTimeout: config.ReadHeaderTimeoutDuration(),
+		ReadTimeout:       config.ReadTimeoutDuration(),
+		WriteTimeout:      config.WriteTimeoutDuration(),
+		IdleTimeout:       config.IdleTimeoutDuration(),
+		Handler:           internal.TraceRequests(http.DefaultServeMux, utils.LogRequests(internal.ObserveRequests(http.DefaultServeMux))),
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		// Every request context is canceled when shutdown starts, which ends the event streams and live connections
+		BaseContext: func(net.Listener) context.Context {
+			return streams
+		},
+	}
+	server.RegisterOnShutdown(stopStreams)
+	adminServer := &http.Server{
+		Addr:              routeContext.Config().Admin.Address,
+		ReadHeaderTimeout: config.ReadHeaderTimeoutDuration(),
+		ReadTimeout:       config.ReadTimeoutDuration(),
+		WriteTimeout:      config.WriteTimeoutDuration(),
+		IdleTimeout:       config.IdleTimeoutDuration(),
+		Handler:           admin,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	// Both listeners may fail, and report once more when they are shut down
+	failed := make(chan error, 4)
+	go func() {
+		utils.LogData{
+			Message: "Listening",
+			Data:    server.Addr,
+		}.Log()
+		failed <- server.ListenAndServe()
+	}()
+	if routeContext.Config().Admin.Enabled() {
+		go func() {
+			utils.LogData{
+				Message: "Admin listening",
+				Data:    adminServer.Addr,
+			}.Log()
+			failed <- adminServer.ListenAndServe()
+		}()
+	}
+
+	exitCode := 0
+	select {
+	case err := <-failed:
+		utils.LogData{
+			Message: "Failed to listen",
+			Data:    err,
+			Level:   slog.LevelError,
+		}.Log()
+		exitCode = 1
+	case <-signals.Done():
+	}
+	stopSignals()
 
+	// Shut down in order: fail the health, wait for the load balancers to notice, drain the requests,
+	// close the admin listener, then stop the background jobs and the listener, close the store and flush the traces.
+	// A failed listener isn't receiving requests anymore, so there is nothing to wait for.
+	routeContext.Health.SetStopping()
+	if exitCode == 0 {
+		utils.LogData{
+			Message: "Shutting down",
+			Data:    config.DrainDelayDuration().String(),
+		}.Log()
+		time.Sleep(config.DrainDelayDuration())
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeoutDuration())
+	defer cancel()
+	err = server.Shutdown(shutdown)
 	if err != nil {
-		panic(err)
+		utils.LogData{
+			Message: "Requests did not finish in time, closing their connections",
+			Data:    err,
+			Level:   slog.LevelWarn,
+		}.Log()
+		_ = server.Close()
+	}
+	// The admin listener stays up while draining, so the shutdown can be watched in the metrics
+	if routeContext.Config().Admin.Enabled() {
+		_ = adminServer.Shutdown(shutdown)
+	}
+
+	stopJobs()
+	running.Wait()
+	routeContext.Store.Close()
+	flush, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	err = flushTraces(flush)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to flush traces",
+			Data:    err,
+			Level:   slog.LevelWarn,
+		}.Log()
+	}
+	utils.LogData{Message: "Shut down"}.Log()
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// startup connects to the database and starts the background jobs, which are tracked by running.
+// Failing to start exits, unless the server is shutting down anyway.
+func startup(ctx internal.RouteContext, running *sync.WaitGroup) {
+	err := ctx.Connect()
+	if ctx.Context.Err() != nil {
+		return
+	}
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to start",
+			Data:    err,
+			Level:   slog.LevelError,
+		}.Log()
+		os.Exit(1)
+	}
+	utils.LogData{Message: "Connected to database"}.Log()
+
+	running.Add(3)
+	go func() {
+		defer running.Done()
+		ctx.Changes.Listen(ctx.Context)
+	}()
+	go func() {
+		defer running.Done()
+		ctx.Store.Monitor(ctx.Context)
+	}()
+	go func() {
+		defer running.Done()
+		routes.PruneChangeLog(ctx)
+	}()
+	if ctx.Config().InMemory {
+		ctx.Health.SetStarting("Loading dataset")
+		err := routes.ServeFromMemory(ctx)
+		if ctx.Context.Err() != nil {
+			return
+		}
+		if err != nil {
+			utils.LogData{
+				Message: "Failed to load dataset",
+				Data:    err,
+				Level:   slog.LevelError,
+			}.Log()
+			os.Exit(1)
+		}
+	}
+	ctx.Health.SetStarting("Building entries")
+	err = routes.WarmEntries(ctx)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to warm entries",
+			Data:    err,
+			Level:   slog.LevelWarn,
+		}.Log()
+	}
+	ctx.Health.SetReady()
+	if ctx.Config().Snapshots.Enabled() {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			routes.PublishSnapshots(ctx)
+		}()
 	}
 }
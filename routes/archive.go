@@ -0,0 +1,480 @@
+package routes
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	archiveFormat = "cosmetics-archive"
+	// Raised whenever the files of the archive change in a way older builds can't read
+	archiveVersion = 1
+	manifestFile   = "manifest.json"
+	cosmeticsFile  = "cosmetics.json"
+	playersFile    = "players.json"
+	grantsFile     = "grants.json"
+)
+
+const (
+	ImportMerge   = "merge"
+	ImportReplace = "replace"
+)
+
+// Archives are transferred as a whole, which takes longer than the server timeouts allow for regular requests
+const archiveTransferTimeout = 5 * time.Minute
+
+const maxImportBytes = 512 << 20
+
+var errInvalidArchive = errors.New("invalid archive")
+
+type archiveFile struct {
+	Sha256  string `json:"sha256"`
+	Entries int    `json:"entries"`
+}
+
+// archiveManifest is the first file of an archive, it describes the files following it
+type archiveManifest struct {
+	Format    string                 `json:"format"`
+	Version   int                    `json:"version"`
+	CreatedAt time.Time              `json:"created_at"`
+	Migration uint                   `json:"migration"`
+	Files     map[string]archiveFile `json:"files"`
+}
+
+// Archive is a dataset read from a single consistent state of the store along with its manifest.
+// Its files are encoded once to fill in the manifest, so everything that can fail is done before any of it is written,
+// and encoded again straight into the output when it's written.
+// The dataset itself is held in memory rather than streamed from the store: the manifest comes first in the archive
+// and needs the hash of every file.
+type Archive struct {
+	manifest archiveManifest
+	dataset  internal.Dataset
+}
+
+type archiveSection struct {
+	name    string
+	entries interface{}
+}
+
+// sections lists the files following the manifest, in the order they are written
+func (archive Archive) sections() []archiveSection {
+	return []archiveSection{
+		{cosmeticsFile, archive.dataset.Cosmetics},
+		{playersFile, archive.dataset.Players},
+		{grantsFile, archive.dataset.Grants},
+	}
+}
+
+// sizeWriter counts the bytes written through it
+type sizeWriter struct {
+	out  io.Writer
+	size int64
+}
+
+func (writer *sizeWriter) Write(data []byte) (int, error) {
+	written, err := writer.out.Write(data)
+	writer.size += int64(written)
+	return written, err
+}
+
+// BuildArchive reads the whole dataset and describes its files in the manifest, without keeping their encoded form around
+func BuildArchive(ctx internal.RouteContext) (Archive, error) {
+	dataset, migration, err := ctx.Store.Export(ctx.Context)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	archive := Archive{
+		manifest: archiveManifest{
+			Format:    archiveFormat,
+			Version:   archiveVersion,
+			CreatedAt: time.Now().UTC(),
+			Migration: migration,
+			Files:     make(map[string]archiveFile),
+		},
+		dataset: dataset,
+	}
+	for _, section := range archive.sections() {
+		sum := sha256.New()
+		if err := json.NewEncoder(sum).Encode(section.entries); err != nil {
+			return archive, err
+		}
+		archive.manifest.Files[section.name] = archiveFile{Sha256: hex.EncodeToString(sum.Sum(nil)), Entries: reflect.ValueOf(section.entries).Len()}
+	}
+	return archive, nil
+}
+
+// Write writes the archive as gzipped tar, the manifest comes first so readers know what to expect
+func (archive Archive) Write(out io.Writer) error {
+	compressed := gzip.NewWriter(out)
+	writer := tar.NewWriter(compressed)
+	manifest, err := json.MarshalIndent(archive.manifest, "", "  ")
+	if err == nil {
+		err = archive.writeHeader(writer, manifestFile, int64(len(manifest)))
+	}
+	if err == nil {
+		_, err = writer.Write(manifest)
+	}
+	if err != nil {
+		return err
+	}
+	for _, section := range archive.sections() {
+		// tar needs the size before the content, which takes one more pass over the entries
+		size := &sizeWriter{out: io.Discard}
+		err := json.NewEncoder(size).Encode(section.entries)
+		if err == nil {
+			err = archive.writeHeader(writer, section.name, size.size)
+		}
+		if err == nil {
+			err = json.NewEncoder(writer).Encode(section.entries)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func (archive Archive) writeHeader(writer *tar.Writer, name string, size int64) error {
+	return writer.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: archive.manifest.CreatedAt,
+	})
+}
+
+// readArchive unpacks an archive and checks it against its manifest, nothing of it is trusted before that
+func readArchive(in io.Reader) (internal.Dataset, archiveManifest, error) {
+	var dataset internal.Dataset
+	var manifest archiveManifest
+	compressed, err := gzip.NewReader(in)
+	if err != nil {
+		return dataset, manifest, fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+	archive := tar.NewReader(compressed)
+	files := make(map[string][]byte)
+	var size int64
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return dataset, manifest, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+		if _, found := files[header.Name]; found {
+			return dataset, manifest, fmt.Errorf("%w: %s is included twice", errInvalidArchive, header.Name)
+		}
+		// The compressed size is limited by the caller, this keeps a small archive from unpacking into something huge
+		size += header.Size
+		if size > maxImportBytes {
+			return dataset, manifest, fmt.Errorf("%w: unpacks to more than %d bytes", errInvalidArchive, maxImportBytes)
+		}
+		files[header.Name], err = io.ReadAll(archive)
+		if err != nil {
+			return dataset, manifest, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+	}
+
+	data, found := files[manifestFile]
+	if !found {
+		return dataset, manifest, fmt.Errorf("%w: %s is missing", errInvalidArchive, manifestFile)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return dataset, manifest, fmt.Errorf("%w: %s: %w", errInvalidArchive, manifestFile, err)
+	}
+	if manifest.Format != archiveFormat {
+		return dataset, manifest, fmt.Errorf("%w: not a cosmetics archive", errInvalidArchive)
+	}
+	if manifest.Version != archiveVersion {
+		return dataset, manifest, fmt.Errorf("%w: archive version %d is not supported, expected %d", errInvalidArchive, manifest.Version, archiveVersion)
+	}
+	for name := range files {
+		if _, listed := manifest.Files[name]; !listed && name != manifestFile {
+			return dataset, manifest, fmt.Errorf("%w: %s is not listed in the manifest", errInvalidArchive, name)
+		}
+	}
+
+	sections := map[string]interface{}{cosmeticsFile: &dataset.Cosmetics, playersFile: &dataset.Players, grantsFile: &dataset.Grants}
+	for name, section := range sections {
+		data, found := files[name]
+		listed, isListed := manifest.Files[name]
+		if !found || !isListed {
+			return dataset, manifest, fmt.Errorf("%w: %s is missing", errInvalidArchive, name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != listed.Sha256 {
+			return dataset, manifest, fmt.Errorf("%w: checksum of %s doesn't match", errInvalidArchive, name)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(section); err != nil {
+			return dataset, manifest, fmt.Errorf("%w: %s: %w", errInvalidArchive, name, err)
+		}
+		if entries := reflect.ValueOf(section).Elem().Len(); entries != listed.Entries {
+			return dataset, manifest, fmt.Errorf("%w: %s has %d entries, the manifest lists %d", errInvalidArchive, name, entries, listed.Entries)
+		}
+	}
+	if err := normalizeDataset(&dataset); err != nil {
+		return dataset, manifest, fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+	return dataset, manifest, nil
+}
+
+// normalizeDataset checks every entry the same way the api does and brings the player ids into the form the store returns
+func normalizeDataset(dataset *internal.Dataset) error {
+	cosmetics := make(map[string]bool, len(dataset.Cosmetics))
+	for _, cosmetic := range dataset.Cosmetics {
+		if !utils.IsValidResourceLocationNamespace(cosmetic.Id) {
+			return fmt.Errorf("invalid cosmetic id %q", cosmetic.Id)
+		}
+		if cosmetics[cosmetic.Id] {
+			return fmt.Errorf("cosmetic %s is included twice", cosmetic.Id)
+		}
+		cosmetics[cosmetic.Id] = true
+		if cosmetic.Version != nil && *cosmetic.Version < 1 {
+			return fmt.Errorf("invalid version %d of cosmetic %s", *cosmetic.Version, cosmetic.Id)
+		}
+		if !json.Valid(cosmetic.Data) {
+			return fmt.Errorf("invalid data of cosmetic %s", cosmetic.Id)
+		}
+	}
+	players := make(map[string]bool, len(dataset.Players))
+	for i, player := range dataset.Players {
+		id, err := uuid.Parse(player.Id)
+		if err != nil {
+			return fmt.Errorf("invalid player id %q", player.Id)
+		}
+		dataset.Players[i].Id = id.String()
+		if players[id.String()] {
+			return fmt.Errorf("player %s is included twice", id)
+		}
+		players[id.String()] = true
+		if !json.Valid(player.Data) {
+			return fmt.Errorf("invalid data of player %s", id)
+		}
+	}
+	grants := make(map[internal.Grant]bool, len(dataset.Grants))
+	for i, grant := range dataset.Grants {
+		id, err := uuid.Parse(grant.Player)
+		if err != nil {
+			return fmt.Errorf("invalid player id %q in grant", grant.Player)
+		}
+		grant.Player = id.String()
+		dataset.Grants[i] = grant
+		if !players[grant.Player] {
+			return fmt.Errorf("grant of %s to player %s, who isn't included", grant.Cosmetic, grant.Player)
+		}
+		if grants[grant] {
+			return fmt.Errorf("grant of %s to player %s is included twice", grant.Cosmetic, grant.Player)
+		}
+		grants[grant] = true
+	}
+	return nil
+}
+
+// importCounts compares the archive to the store, entries in the store but not in the archive are only deleted when replacing
+type importCounts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+}
+
+type ImportReport struct {
+	Mode      string          `json:"mode"`
+	DryRun    bool            `json:"dry_run"`
+	Applied   bool            `json:"applied"`
+	Archive   archiveManifest `json:"archive"`
+	Cosmetics importCounts    `json:"cosmetics"`
+	Players   importCounts    `json:"players"`
+	Grants    importCounts    `json:"grants"`
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var left, right interface{}
+	if json.Unmarshal(a, &left) != nil || json.Unmarshal(b, &right) != nil {
+		return false
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func countChanges[T any](current, next []T, key func(T) string, equal func(T, T) bool, replace bool) importCounts {
+	var counts importCounts
+	existing := make(map[string]T, len(current))
+	for _, entry := range current {
+		existing[key(entry)] = entry
+	}
+	for _, entry := range next {
+		old, found := existing[key(entry)]
+		switch {
+		case !found:
+			counts.Created++
+		case equal(old, entry):
+			counts.Unchanged++
+		default:
+			counts.Updated++
+		}
+		delete(existing, key(entry))
+	}
+	if replace {
+		counts.Deleted = len(existing)
+	}
+	return counts
+}
+
+func (report *ImportReport) count(current, next internal.Dataset) {
+	replace := report.Mode == ImportReplace
+	report.Cosmetics = countChanges(current.Cosmetics, next.Cosmetics, func(cosmetic internal.StoredCosmetic) string {
+		return cosmetic.Id
+	}, func(a, b internal.StoredCosmetic) bool {
+		return reflect.DeepEqual(a.Version, b.Version) && jsonEqual(a.Data, b.Data)
+	}, replace)
+	report.Players = countChanges(current.Players, next.Players, func(player internal.StoredPlayer) string {
+		return player.Id
+	}, func(a, b internal.StoredPlayer) bool {
+		return jsonEqual(a.Data, b.Data)
+	}, replace)
+	report.Grants = countChanges(current.Grants, next.Grants, func(grant internal.Grant) string {
+		return grant.Player + "/" + grant.Cosmetic
+	}, func(internal.Grant, internal.Grant) bool {
+		return true
+	}, replace)
+}
+
+// ImportArchive applies an archive at once. Merging overwrites the entries of the archive and keeps everything else,
+// replacing deletes everything that isn't part of the archive. A dry run applies the archive just the same but rolls it back,
+// so it fails on everything the real import would fail on. Every instance reloads afterward, as the import may have touched any entry.
+func ImportArchive(ctx internal.RouteContext, in io.Reader, mode string, dryRun bool) (ImportReport, error) {
+	report := ImportReport{Mode: mode, DryRun: dryRun}
+	if mode != ImportMerge && mode != ImportReplace {
+		return report, fmt.Errorf("%w: invalid mode %q, expected %s or %s", errInvalidArchive, mode, ImportMerge, ImportReplace)
+	}
+	dataset, manifest, err := readArchive(in)
+	if err != nil {
+		return report, err
+	}
+	report.Archive = manifest
+	latest, err := internal.LatestMigration()
+	if err != nil {
+		return report, err
+	}
+	if manifest.Migration > latest {
+		return report, fmt.Errorf("%w: archive was exported from database migration %d, this build only knows up to %d", errInvalidArchive, manifest.Migration, latest)
+	}
+
+	current, err := ctx.Store.Import(ctx.Context, dataset, mode == ImportReplace, dryRun)
+	if errors.Is(err, internal.ErrInvalid) || errors.Is(err, internal.ErrNotFound) || errors.Is(err, internal.ErrUnknownCosmetic) {
+		return report, fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+	if err != nil {
+		return report, err
+	}
+	report.count(current, dataset)
+	if dryRun {
+		return report, nil
+	}
+	report.Applied = true
+	publishChange(ctx, internal.Change{Type: internal.DatasetImported})
+	return report, nil
+}
+
+// ExportDataset sends every cosmetic, player and grant as an archive, which ImportDataset accepts on another deployment
+func ExportDataset(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	_ = http.NewResponseController(res).SetWriteDeadline(time.Now().Add(archiveTransferTimeout))
+	archive, err := BuildArchive(ctx)
+	if unavailable(ctx, res, req, err) {
+		return
+	}
+	if err != nil {
+		internalError(res, req, "Failed to export dataset", err)
+		return
+	}
+	name := fmt.Sprintf("cosmetics-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	res.Header().Set("Content-Type", "application/gzip")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	err = archive.Write(res)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to send export",
+			Data:    err,
+			Level:   slog.LevelWarn,
+		}.LogContext(req.Context())
+	}
+}
+
+// ImportDataset applies an uploaded archive, the mode query parameter is either merge, the default, or replace.
+// With dry_run=true nothing is changed, the report shows what the import would change.
+func ImportDataset(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	_ = http.NewResponseController(res).SetReadDeadline(time.Now().Add(archiveTransferTimeout))
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ImportMerge
+	}
+	dryRun := false
+	if value := req.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(res, "Invalid dry_run")
+			return
+		}
+	}
+
+	report, err := ImportArchive(ctx, http.MaxBytesReader(res, req.Body, maxImportBytes), mode, dryRun)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errInvalidArchive) {
+		utils.LogData{
+			Message: "Rejected import",
+			Data:    err,
+			Level:   slog.LevelWarn,
+		}.LogContext(req.Context())
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, err.Error())
+		return
+	}
+	if unavailable(ctx, res, req, err) {
+		return
+	}
+	if err != nil {
+		internalError(res, req, "Failed to import dataset", err)
+		return
+	}
+	utils.LogData{
+		Message: "Imported dataset",
+		Data:    report,
+	}.LogContext(req.Context())
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		internalError(res, req, "Failed to encode import report", err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(data)
+}
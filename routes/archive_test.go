@@ -0,0 +1,224 @@
+package routes
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"cosmetics/internal"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exportArchive builds an archive of the store like the export endpoint
+func exportArchive(t *testing.T, ctx internal.RouteContext) []byte {
+	t.Helper()
+	res := serve(ctx, ExportDataset, httptest.NewRequest("GET", "/export", nil), nil)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("expected an archive, got %d: %s", res.Code, res.Body.String())
+	}
+	return res.Body.Bytes()
+}
+
+func exportDataset(t *testing.T, ctx internal.RouteContext) internal.Dataset {
+	t.Helper()
+	dataset, _, err := ctx.Store.Export(ctx.Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dataset
+}
+
+// packArchive writes the files as gzipped tar in the given order, without checking them
+func packArchive(t *testing.T, files ...archiveSection) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	compressed := gzip.NewWriter(&out)
+	writer := tar.NewWriter(compressed)
+	for _, file := range files {
+		data := file.entries.([]byte)
+		if err := writer.WriteHeader(&tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = writer.Write(data)
+	}
+	_ = writer.Close()
+	_ = compressed.Close()
+	return out.Bytes()
+}
+
+// unpackArchive reads the files of an archive without checking them
+func unpackArchive(t *testing.T, data []byte) []archiveSection {
+	t.Helper()
+	compressed, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(compressed)
+	var files []archiveSection
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(reader)
+		files = append(files, archiveSection{header.Name, content})
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	source := newTestContext(t)
+	for _, write := range []func() error{
+		func() error { return PutCosmetic(source, "hat", strings.NewReader(`{"version": 2, "model": "hat"}`)) },
+		func() error { return GrantCosmetic(source, defaultPlayer, "hat") },
+		func() error { return GrantCosmetic(source, "00000000-0000-0000-0000-000000000001", "default") },
+	} {
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := exportArchive(t, source)
+
+	var names []string
+	for _, file := range unpackArchive(t, data) {
+		names = append(names, file.name)
+	}
+	if want := []string{manifestFile, cosmeticsFile, playersFile, grantsFile}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected the files %v, got %v", want, names)
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		dryRun  bool
+		applied bool
+		players importCounts
+	}{
+		{"dry run", ImportReplace, true, false, importCounts{Created: 1, Unchanged: 1}},
+		{"merge", ImportMerge, false, true, importCounts{Created: 1, Unchanged: 1}},
+		{"replace", ImportReplace, false, true, importCounts{Created: 1, Unchanged: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := newTestContext(t)
+			before := exportDataset(t, target)
+			report, err := ImportArchive(target, bytes.NewReader(data), test.mode, test.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Applied != test.applied || report.Players != test.players || report.Archive.Files[grantsFile].Entries != 3 {
+				t.Errorf("unexpected report %+v", report)
+			}
+			after := exportDataset(t, target)
+			want := exportDataset(t, source)
+			if !test.applied {
+				want = before
+			}
+			// The store may format the data of the entries differently, only their content has to match
+			wantData, _ := json.Marshal(want)
+			afterData, _ := json.Marshal(after)
+			if !jsonEqual(afterData, wantData) {
+				t.Errorf("expected %s, got %s", wantData, afterData)
+			}
+		})
+	}
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	source := newTestContext(t)
+	files := unpackArchive(t, exportArchive(t, source))
+	manifest := files[0].entries.([]byte)
+	withManifest := func(change func(*archiveManifest), replaced ...archiveSection) []byte {
+		var changed archiveManifest
+		_ = json.Unmarshal(manifest, &changed)
+		change(&changed)
+		data, _ := json.Marshal(changed)
+		sections := append([]archiveSection{{manifestFile, data}}, files[1:]...)
+		for _, replacement := range replaced {
+			for i := range sections {
+				if sections[i].name == replacement.name {
+					sections[i] = replacement
+				}
+			}
+		}
+		return packArchive(t, sections...)
+	}
+	badCosmetics := []byte(`[{"id": "Not Valid", "version": 1, "data": {}}]`)
+	badSum := sha256.Sum256(badCosmetics)
+
+	tests := []struct {
+		name    string
+		mode    string
+		archive []byte
+		error   string
+	}{
+		{"invalid mode", "append", packArchive(t, files...), `invalid mode "append"`},
+		{"not gzip", ImportMerge, []byte("plain text"), "gzip: invalid header"},
+		{"missing manifest", ImportMerge, packArchive(t, files[1:]...), "manifest.json is missing"},
+		{"missing file", ImportMerge, packArchive(t, files[:3]...), "grants.json is missing"},
+		{"duplicate file", ImportMerge, packArchive(t, append(files, files[1])...), "cosmetics.json is included twice"},
+		{"unlisted file", ImportMerge, packArchive(t, append(files, archiveSection{"extra.json", []byte("[]")})...), "extra.json is not listed"},
+		{"other format", ImportMerge, withManifest(func(manifest *archiveManifest) { manifest.Format = "zip" }), "not a cosmetics archive"},
+		{"newer version", ImportMerge, withManifest(func(manifest *archiveManifest) { manifest.Version = archiveVersion + 1 }), "archive version 2 is not supported"},
+		{"newer migration", ImportMerge, withManifest(func(manifest *archiveManifest) { manifest.Migration = 1000 }), "this build only knows up to"},
+		{"checksum", ImportMerge, withManifest(func(manifest *archiveManifest) { manifest.Files[playersFile] = archiveFile{Sha256: "00"} }), "checksum of players.json doesn't match"},
+		{"entry count", ImportMerge, withManifest(func(manifest *archiveManifest) {
+			listed := manifest.Files[grantsFile]
+			listed.Entries++
+			manifest.Files[grantsFile] = listed
+		}), "the manifest lists 2"},
+		{"invalid entry", ImportMerge, withManifest(func(manifest *archiveManifest) {
+			manifest.Files[cosmeticsFile] = archiveFile{Sha256: hex.EncodeToString(badSum[:]), Entries: 1}
+		}, archiveSection{cosmeticsFile, badCosmetics}), `invalid cosmetic id "Not Valid"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := newTestContext(t)
+			before := exportDataset(t, target)
+			_, err := ImportArchive(target, bytes.NewReader(test.archive), test.mode, false)
+			if !errors.Is(err, errInvalidArchive) || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("expected %q, got %v", test.error, err)
+			}
+			if after := exportDataset(t, target); !reflect.DeepEqual(after, before) {
+				t.Error("expected a rejected archive to change nothing")
+			}
+		})
+	}
+}
+
+// failingReader returns the data and then the error, like a request body cut off by http.MaxBytesReader
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (reader failingReader) Read(data []byte) (int, error) {
+	read, err := reader.data.Read(data)
+	if errors.Is(err, io.EOF) {
+		return read, reader.err
+	}
+	return read, err
+}
+
+func TestImportTooLarge(t *testing.T) {
+	ctx := newTestContext(t)
+	archive := exportArchive(t, ctx)
+	tooLarge := &http.MaxBytesError{Limit: maxImportBytes}
+	for _, cut := range []int{5, len(archive) / 2} {
+		_, err := ImportArchive(ctx, failingReader{bytes.NewReader(archive[:cut]), tooLarge}, ImportMerge, false)
+		var maxBytes *http.MaxBytesError
+		if !errors.As(err, &maxBytes) {
+			t.Errorf("cut after %d bytes: expected the size limit to be kept, got %v", cut, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"bytes"
+	"cosmetics/utils"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const jsonContentType = "application/json"
+
+// binaryContentType is a compact encoding of a Response, clients opt in through the Accept header.
+//
+// Numbers are unsigned LEB128 varints and strings are a varint byte length followed by utf-8 bytes.
+//
+//	magic       "CSMT"
+//	version     1 byte, currently 1
+//	ids         varint count, then every cosmetic id as string
+//	cosmetics   varint count, then per definition: varint index into ids, definition json as string
+//	players     varint count, then per player:
+//	              uuid        16 bytes, big endian
+//	              extra_data  json as string
+//	              cosmetics   varint count, then a varint index into ids per cosmetic
+//
+// Definitions without an id are left out, the players granted them still refer to the id.
+const binaryContentType = "application/x-cosmetics-binary"
+
+const binaryVersion = 1
+
+type binaryWriter struct {
+	buffer bytes.Buffer
+	ids    map[string]int
+	order  []string
+}
+
+func (writer *binaryWriter) uvarint(value uint64) {
+	writer.buffer.Write(binary.AppendUvarint(nil, value))
+}
+
+func (writer *binaryWriter) string(value []byte) {
+	writer.uvarint(uint64(len(value)))
+	writer.buffer.Write(value)
+}
+
+func (writer *binaryWriter) intern(id string) {
+	if _, ok := writer.ids[id]; !ok {
+		writer.ids[id] = len(writer.order)
+		writer.order = append(writer.order, id)
+	}
+}
+
+func encodeBinary(response Response) ([]byte, error) {
+	writer := &binaryWriter{ids: make(map[string]int)}
+
+	definitions := make([][]byte, 0, len(response.Cosmetics))
+	definitionIds := make([]string, 0, len(response.Cosmetics))
+	for _, cosmetic := range response.Cosmetics {
+		definition, _ := cosmetic.(map[string]interface{})
+		id, ok := definition["id"].(string)
+		if !ok {
+			// Like the {} of the default migration data, one broken definition must not take the whole dump down with it.
+			// Every rebuild of the entries runs into it again, so it's only logged for debugging.
+			utils.LogData{
+				Message: "Skipping cosmetic definition without id in binary entries",
+				Data:    cosmetic,
+				Level:   slog.LevelDebug,
+			}.Log()
+			continue
+		}
+		data, err := json.Marshal(definition)
+		if err != nil {
+			return nil, err
+		}
+		writer.intern(id)
+		definitions = append(definitions, data)
+		definitionIds = append(definitionIds, id)
+	}
+	for _, player := range response.Players {
+		for _, cosmetic := range player.Cosmetics {
+			writer.intern(cosmetic)
+		}
+	}
+
+	writer.buffer.WriteString("CSMT")
+	writer.buffer.WriteByte(binaryVersion)
+
+	writer.uvarint(uint64(len(writer.order)))
+	for _, id := range writer.order {
+		writer.string([]byte(id))
+	}
+
+	writer.uvarint(uint64(len(definitions)))
+	for i, definition := range definitions {
+		writer.uvarint(uint64(writer.ids[definitionIds[i]]))
+		writer.string(definition)
+	}
+
+	writer.uvarint(uint64(len(response.Players)))
+	for _, player := range response.Players {
+		id, err := uuid.Parse(player.Player)
+		if err != nil {
+			return nil, err
+		}
+		writer.buffer.Write(id[:])
+
+		data, err := json.Marshal(player.Data)
+		if err != nil {
+			return nil, err
+		}
+		writer.string(data)
+
+		writer.uvarint(uint64(len(player.Cosmetics)))
+		for _, cosmetic := range player.Cosmetics {
+			writer.uvarint(uint64(writer.ids[cosmetic]))
+		}
+	}
+
+	return writer.buffer.Bytes(), nil
+}
+
+// negotiateFormat picks between json and the binary format, json stays the default
+func negotiateFormat(res http.ResponseWriter, req *http.Request) string {
+	res.Header().Add("Vary", "Accept")
+	return utils.NegotiateContentType(req.Header.Get("Accept"), jsonContentType, binaryContentType)
+}
+
+// encodeResponse encodes the response in the given format
+func encodeResponse(format string, response Response) ([]byte, error) {
+	if format == binaryContentType {
+		return encodeBinary(response)
+	}
+	return json.Marshal(response)
+}
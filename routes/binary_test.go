@@ -0,0 +1,165 @@
+package routes
+
+import (
+	"bytes"
+	"cosmetics/utils"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// binaryReader decodes the format documented at binaryContentType
+type binaryReader struct {
+	t    *testing.T
+	data *bytes.Reader
+}
+
+func (reader binaryReader) uvarint() uint64 {
+	value, err := binary.ReadUvarint(reader.data)
+	if err != nil {
+		reader.t.Fatal(err)
+	}
+	return value
+}
+
+func (reader binaryReader) bytes(length int) []byte {
+	value := make([]byte, length)
+	if _, err := reader.data.Read(value); err != nil && length != 0 {
+		reader.t.Fatal(err)
+	}
+	return value
+}
+
+func (reader binaryReader) string() []byte {
+	return reader.bytes(int(reader.uvarint()))
+}
+
+func decodeBinary(t *testing.T, data []byte) Response {
+	t.Helper()
+	reader := binaryReader{t, bytes.NewReader(data)}
+	if magic := string(reader.bytes(4)); magic != "CSMT" {
+		t.Fatalf("unexpected magic %q", magic)
+	}
+	if version := reader.bytes(1)[0]; version != binaryVersion {
+		t.Fatalf("unexpected version %d", version)
+	}
+
+	ids := make([]string, reader.uvarint())
+	for i := range ids {
+		ids[i] = string(reader.string())
+	}
+
+	result := Response{Cosmetics: make([]interface{}, reader.uvarint())}
+	for i := range result.Cosmetics {
+		id := ids[reader.uvarint()]
+		var definition map[string]interface{}
+		if err := json.Unmarshal(reader.string(), &definition); err != nil {
+			t.Fatal(err)
+		}
+		if definition["id"] != id {
+			t.Errorf("definition %v is stored under id %s", definition, id)
+		}
+		result.Cosmetics[i] = definition
+	}
+
+	result.Players = make([]PlayerType, reader.uvarint())
+	for i := range result.Players {
+		id, err := uuid.FromBytes(reader.bytes(16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		player := PlayerType{Player: id.String()}
+		if err := json.Unmarshal(reader.string(), &player.Data); err != nil {
+			t.Fatal(err)
+		}
+		player.Cosmetics = make([]string, reader.uvarint())
+		for j := range player.Cosmetics {
+			player.Cosmetics[j] = ids[reader.uvarint()]
+		}
+		result.Players[i] = player
+	}
+	if reader.data.Len() != 0 {
+		t.Errorf("%d bytes left after decoding", reader.data.Len())
+	}
+	return result
+}
+
+func TestEncodeBinary(t *testing.T) {
+	hat := map[string]interface{}{"id": "hat", "version": float64(2)}
+	cape := map[string]interface{}{"id": "cape", "version": float64(1), "texture": "cape.png"}
+	player := PlayerType{Player: defaultPlayer, Data: map[string]interface{}{"default": "data"}, Cosmetics: []string{"cape", "hat"}}
+
+	tests := []struct {
+		name     string
+		response Response
+		want     Response
+	}{
+		{
+			"empty",
+			Response{Players: []PlayerType{}, Cosmetics: []interface{}{}},
+			Response{Players: []PlayerType{}, Cosmetics: []interface{}{}},
+		},
+		{
+			"interned ids",
+			Response{Players: []PlayerType{player}, Cosmetics: []interface{}{hat, cape}},
+			Response{Players: []PlayerType{player}, Cosmetics: []interface{}{hat, cape}},
+		},
+		{
+			// The entries of the 000002_default_data migration, the default cosmetic is stored as {}
+			"default migration data",
+			Response{
+				Players:   []PlayerType{{Player: defaultPlayer, Data: map[string]interface{}{"default": "data"}, Cosmetics: []string{"default"}}},
+				Cosmetics: []interface{}{map[string]interface{}{}},
+			},
+			Response{
+				Players:   []PlayerType{{Player: defaultPlayer, Data: map[string]interface{}{"default": "data"}, Cosmetics: []string{"default"}}},
+				Cosmetics: []interface{}{},
+			},
+		},
+		{
+			"definitions without id are skipped",
+			Response{Players: []PlayerType{}, Cosmetics: []interface{}{[]interface{}{}, map[string]interface{}{"id": 1}, hat}},
+			Response{Players: []PlayerType{}, Cosmetics: []interface{}{hat}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := encodeBinary(test.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decodeBinary(t, data); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestEncodeBinaryInvalidPlayer(t *testing.T) {
+	_, err := encodeBinary(Response{Players: []PlayerType{{Player: "not-a-uuid"}}})
+	if err == nil {
+		t.Error("expected an error for a player id that isn't a uuid")
+	}
+}
+
+func TestNewEntriesSnapshotDefaultData(t *testing.T) {
+	ctx := newTestContext(t)
+	result, err := fetchEntries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	utils.SetupLogging(&logs, utils.LogFormatJson, slog.LevelInfo)
+	defer utils.SetupLogging(os.Stdout, utils.LogFormatJson, slog.LevelInfo)
+	if _, err := newEntriesSnapshot(result); err != nil {
+		t.Fatalf("the entries of a fresh database must build: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("the default data is rebuilt every few seconds, it must not log: %s", logs.String())
+	}
+}
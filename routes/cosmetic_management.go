@@ -4,72 +4,76 @@ import (
 	"cosmetics/internal"
 	"cosmetics/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net/http"
 )
 
-const createQuery = `
-	insert into cosmetics(id, version, data) values($1, $2, $3) on conflict (id) do update set version = $2, data = $3
-`
-
-func CreateOrUpdateCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
-	cosmeticId := req.PathValue("cosmetic_id")
+// PutCosmetic creates or updates a cosmetic from its json definition and publishes the change.
+// The api and the cosmetic put command both go through it.
+func PutCosmetic(ctx internal.RouteContext, cosmeticId string, body io.Reader) error {
 	var data = make(map[string]interface{})
-	err := json.NewDecoder(req.Body).Decode(&data)
+	err := json.NewDecoder(body).Decode(&data)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		return
+		return fmt.Errorf("%w: %w", invalidRequest("Invalid json"), err)
 	}
 	data["id"] = cosmeticId
 	utils.LogData{
 		Message: "Trying to create cosmetic",
 		Data:    data,
-	}.Log()
+		Level:   slog.LevelDebug,
+	}.LogContext(ctx.Context)
 	if cosmeticId == "" || !utils.IsValidResourceLocationNamespace(cosmeticId) {
-		res.WriteHeader(http.StatusBadRequest)
-		_, _ = io.WriteString(res, "Invalid cosmetic Id")
-		utils.LogData{
-			Message: "Invalid create cosmetic request, invalid cosmetic id",
-			Data:    cosmeticId,
-		}.Log()
-		return
+		return invalidRequest("Invalid cosmetic Id")
 	}
 
-	var version = data["version"]
-	_, ok := version.(float64)
-	if version == nil || !ok {
-		res.WriteHeader(http.StatusBadRequest)
-		_, _ = io.WriteString(res, "No version field")
-		utils.LogData{
-			Message: "Invalid create cosmetic request, no version field",
-			Data:    cosmeticId,
-		}.Log()
-		return
+	number, ok := data["version"].(float64)
+	if !ok {
+		return invalidRequest("No version field")
+	}
+	if number != math.Trunc(number) {
+		return invalidRequest("Invalid version")
 	}
 
 	jsonData, _ := json.Marshal(data)
-	_, err = ctx.Pool.Exec(ctx.Context, createQuery, cosmeticId, version, jsonData)
+	versionNumber := int(number)
+	err = ctx.Store.PutCosmetic(ctx.Context, internal.StoredCosmetic{Id: cosmeticId, Version: &versionNumber, Data: jsonData})
+	if err != nil {
+		return err
+	}
+	publishChange(ctx, internal.Change{Type: internal.CosmeticUpdated, Cosmetic: cosmeticId})
+	utils.LogData{
+		Message: "Created cosmetic",
+		Data:    cosmeticId,
+	}.LogContext(ctx.Context)
+	return nil
+}
+
+func CreateOrUpdateCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	err := PutCosmetic(ctx, req.PathValue("cosmetic_id"), req.Body)
+	if rejected(res, req, err) || unavailable(ctx, res, req, err) {
+		return
+	}
+	if errors.Is(err, internal.ErrInvalid) {
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, err.Error())
+		return
+	}
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
 		utils.LogData{
 			Message: "Failed to create cosmetic",
 			Data:    err,
-		}.Log()
+			Level:   slog.LevelError,
+		}.LogContext(req.Context())
 		return
 	}
-	utils.LogData{
-		Message: "Created cosmetic",
-		Data:    cosmeticId,
-	}.Log()
-
 	res.WriteHeader(http.StatusOK)
 }
 
-const getQuery = `
-	select data from cosmetics where id = $1
-`
-
 func GetCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	cosmeticId := req.PathValue("cosmetic_id")
 	if !utils.IsValidResourceLocationNamespace(cosmeticId) {
@@ -77,89 +81,92 @@ func GetCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.R
 		return
 	}
 
-	result, err := ctx.Pool.Query(ctx.Context, getQuery, cosmeticId)
-	if err != nil {
-		utils.PrintData(result)
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+	data, err := ctx.Store.Cosmetic(ctx.Context, cosmeticId)
+	ctx.Health.Observe(err)
+	if internal.IsUnavailable(err) && writeStale(ctx, res, req, http.StatusNotFound, func(snapshot *entriesSnapshot) (interface{}, bool) {
+		cosmetic, found := snapshot.cosmetics[cosmeticId]
+		return cosmetic, found
+	}) {
 		return
 	}
-	defer result.Close()
-	if !result.Next() {
+	if errors.Is(err, internal.ErrNotFound) {
 		res.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		internalError(res, req, "Failed to get cosmetic", err)
+		return
+	}
 
 	res.Header().Set("Content-Type", "application/json")
-	_, _ = res.Write(result.RawValues()[0])
+	writeWithETag(res, req, utils.ETag(data), data)
 }
 
-const deleteQuery = `
-	delete from cosmetics where id = $1
-`
+// queryCosmetics looks up the definitions of all given cosmetics at once, unknown ids are left out
+func queryCosmetics(ctx internal.RouteContext, ids []string) ([]interface{}, error) {
+	if ctx.Config().InMemory {
+		return memory.cosmeticsByIds(ids)
+	}
+	return ctx.Store.CosmeticsByIds(ctx.Context, ids)
+}
 
 func DeleteCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	cosmeticId := req.PathValue("cosmetic_id")
 	utils.LogData{
 		Message: "Trying to delete cosmetic",
 		Data:    cosmeticId,
-	}.Log()
+		Level:   slog.LevelDebug,
+	}.LogContext(req.Context())
 	if !utils.IsValidResourceLocationNamespace(cosmeticId) {
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	result, err := ctx.Pool.Exec(ctx.Context, deleteQuery, cosmeticId)
-	if err != nil {
+	err := ctx.Store.DeleteCosmetic(ctx.Context, cosmeticId)
+	if unavailable(ctx, res, req, err) {
+		return
+	}
+	if err != nil && !errors.Is(err, internal.ErrNotFound) {
 		utils.LogData{
 			Message: "Failed to delete cosmetic",
 			Data:    err,
-		}.Log()
+			Level:   slog.LevelError,
+		}.LogContext(req.Context())
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if result.RowsAffected() != 1 {
+	if err != nil {
 		res.WriteHeader(http.StatusNotFound)
 		utils.LogData{
 			Message: "Failed to delete cosmetic, no matching found",
 			Data:    cosmeticId,
-		}.Log()
+			Level:   slog.LevelWarn,
+		}.LogContext(req.Context())
 		return
 	}
 
+	publishChange(ctx, internal.Change{Type: internal.CosmeticDeleted, Cosmetic: cosmeticId})
 	utils.LogData{
 		Message: "Deleted cosmetic",
 		Data:    cosmeticId,
-	}.Log()
+	}.LogContext(req.Context())
 	res.WriteHeader(http.StatusOK)
 }
 
-const getCosmeticIds = `
-	select id from cosmetics
-`
-
-func ListCosmeticIds(ctx internal.RouteContext, res http.ResponseWriter, _ *http.Request) {
-	var cosmetics, err = ctx.Pool.Query(ctx.Context, getCosmeticIds)
-	if err != nil {
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+func ListCosmeticIds(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	if ctx.Config().InMemory {
+		writeIds(res, req, memory.cosmeticIds)
 		return
 	}
-
-	var list = make([]string, 0)
-	for cosmetics.Next() {
-		values, err := cosmetics.Values()
-		if err != nil {
-			continue
-		}
-
-		list = append(list, fmt.Sprintf("%v", values[0]))
+	list, err := ctx.Store.CosmeticIds(ctx.Context)
+	if err != nil {
+		internalError(res, req, "Failed to list cosmetics", err)
+		return
 	}
 
 	data, err := json.Marshal(list)
 	if err != nil {
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+		internalError(res, req, "Failed to encode cosmetic ids", err)
 		return
 	}
 
@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPutCosmetic(t *testing.T) {
+	tests := []struct {
+		name     string
+		cosmetic string
+		body     string
+		status   int
+		response string
+	}{
+		{"created", "hat", `{"version": 1, "model": "hat"}`, http.StatusOK, ""},
+		{"invalid json", "hat", `{"version": 1`, http.StatusBadRequest, "Invalid json"},
+		{"invalid id", "Not Valid", `{"version": 1}`, http.StatusBadRequest, "Invalid cosmetic Id"},
+		{"missing version", "hat", `{"model": "hat"}`, http.StatusBadRequest, "No version field"},
+		{"fractional version", "hat", `{"version": 1.5}`, http.StatusBadRequest, "Invalid version"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestContext(t)
+			err := PutCosmetic(ctx, test.cosmetic, strings.NewReader(test.body))
+			var invalid invalidRequest
+			if rejected := errors.As(err, &invalid); rejected != (test.status == http.StatusBadRequest) || (rejected && invalid.Error() != test.response) {
+				t.Errorf("expected %q, got %v", test.response, err)
+			}
+
+			ctx = newTestContext(t)
+			req := httptest.NewRequest("POST", "/cosmetics", strings.NewReader(test.body))
+			res := serve(ctx, CreateOrUpdateCosmetic, req, map[string]string{"cosmetic_id": test.cosmetic})
+			if res.Code != test.status || res.Body.String() != test.response {
+				t.Errorf("expected %d %q, got %d %q", test.status, test.response, res.Code, res.Body.String())
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			res = serve(ctx, GetCosmetic, httptest.NewRequest("GET", "/", nil), map[string]string{"cosmetic_id": test.cosmetic})
+			if !strings.Contains(res.Body.String(), `"id":"hat"`) {
+				t.Errorf("expected the cosmetic to be stored with its id, got %s", res.Body.String())
+			}
+		})
+	}
+}
+
+func TestPutCosmeticUnavailable(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.Store = downStore{ctx.Store}
+	put := func(body string) *httptest.ResponseRecorder {
+		return serve(ctx, CreateOrUpdateCosmetic, httptest.NewRequest("POST", "/", strings.NewReader(body)), map[string]string{"cosmetic_id": "hat"})
+	}
+
+	if res := put(`{"version": 1}`); res.Code != http.StatusServiceUnavailable || !ctx.Health.Status().Degraded {
+		t.Fatalf("expected a 503 and a degraded health, got %d", res.Code)
+	}
+	// A rejected write never reached the database, so it says nothing about its health
+	if res := put(`{}`); res.Code != http.StatusBadRequest || !ctx.Health.Status().Degraded {
+		t.Errorf("expected a 400 that keeps the health degraded, got %d", res.Code)
+	}
+}
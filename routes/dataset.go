@@ -0,0 +1,313 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var errDatasetNotLoaded = errors.New("dataset not loaded yet")
+
+// dataset keeps every cosmetic and player in memory when Config.InMemory is set, so public reads never touch the database.
+// It's loaded once at startup and afterward only the entities named by a change are reloaded from the store.
+type dataset struct {
+	// Serializes loading and applying changes, so an older read never overwrites a newer one
+	updates sync.Mutex
+
+	mutex     sync.RWMutex
+	loaded    bool
+	cosmetics map[string]map[string]interface{}
+	players   map[string]PlayerType
+}
+
+var memory = &dataset{}
+
+// ServeFromMemory loads the whole dataset and keeps it current through the change listener.
+// It only loads once the listener receives notifications, so every change committed after the load is applied.
+// Changes notified before the load are part of it anyway.
+func ServeFromMemory(ctx internal.RouteContext) error {
+	ctx.Changes.OnChange(func(change internal.Change) {
+		memory.apply(ctx, change)
+	})
+	ctx.Changes.OnReconnect(func() {
+		memory.reload(ctx)
+	})
+	select {
+	case <-ctx.Changes.Ready():
+	case <-ctx.Context.Done():
+		return ctx.Context.Err()
+	}
+	return memory.load(ctx)
+}
+
+func (data *dataset) load(ctx internal.RouteContext) error {
+	data.updates.Lock()
+	defer data.updates.Unlock()
+
+	// The export is a single consistent state, so cosmetics and players match each other
+	stored, _, err := ctx.Store.Export(ctx.Context)
+	if err != nil {
+		return err
+	}
+	cosmetics := make(map[string]map[string]interface{}, len(stored.Cosmetics))
+	for _, cosmetic := range stored.Cosmetics {
+		var definition = make(map[string]interface{})
+		if err := json.Unmarshal(cosmetic.Data, &definition); err != nil {
+			return fmt.Errorf("failed to decode cosmetic %s: %w", cosmetic.Id, err)
+		}
+		cosmetics[cosmetic.Id] = definition
+	}
+	players := make(map[string]PlayerType, len(stored.Players))
+	for _, player := range stored.Players {
+		entry := PlayerType{Player: player.Id, Cosmetics: make([]string, 0)}
+		if err := json.Unmarshal(player.Data, &entry.Data); err != nil {
+			return fmt.Errorf("failed to decode player %s: %w", player.Id, err)
+		}
+		players[player.Id] = entry
+	}
+	for _, grant := range stored.Grants {
+		player := players[grant.Player]
+		player.Cosmetics = append(player.Cosmetics, grant.Cosmetic)
+		players[grant.Player] = player
+	}
+
+	data.mutex.Lock()
+	data.cosmetics = cosmetics
+	data.players = players
+	data.loaded = true
+	data.mutex.Unlock()
+
+	entriesCache.Invalidate()
+	utils.LogData{
+		Message: "Loaded dataset into memory",
+		Data: struct {
+			Cosmetics int
+			Players   int
+		}{len(cosmetics), len(players)},
+	}.Log()
+	return nil
+}
+
+func (data *dataset) reload(ctx internal.RouteContext) {
+	if err := data.load(ctx); err != nil {
+		utils.LogData{
+			Message: "Failed to reload dataset",
+			Data:    err.Error(),
+			Level:   slog.LevelError,
+		}.Log()
+	}
+}
+
+// apply reloads whatever the change touched, a change it can't apply falls back to reloading everything
+func (data *dataset) apply(ctx internal.RouteContext, change internal.Change) {
+	if change.Type == internal.DatasetImported {
+		data.mutex.RLock()
+		loaded := data.loaded
+		data.mutex.RUnlock()
+		// Like every change, an import before the initial load is part of it anyway
+		if loaded {
+			data.reload(ctx)
+		}
+		return
+	}
+	err := data.applyChange(ctx, change)
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to apply change to dataset, reloading",
+			Data:    err.Error(),
+			Level:   slog.LevelWarn,
+		}.Log()
+		data.reload(ctx)
+	}
+	// The entries may have been rebuilt from the old state in between, so they are invalidated once more
+	entriesCache.Invalidate()
+}
+
+func (data *dataset) applyChange(ctx internal.RouteContext, change internal.Change) error {
+	data.updates.Lock()
+	defer data.updates.Unlock()
+	// Changes before the initial load are part of it anyway
+	data.mutex.RLock()
+	loaded := data.loaded
+	data.mutex.RUnlock()
+	if !loaded {
+		return nil
+	}
+
+	switch change.Type {
+	case internal.CosmeticUpdated:
+		stored, err := ctx.Store.Cosmetic(ctx.Context, change.Cosmetic)
+		if errors.Is(err, internal.ErrNotFound) {
+			data.removeCosmetic(change.Cosmetic)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var cosmetic = make(map[string]interface{})
+		if err := json.Unmarshal(stored, &cosmetic); err != nil {
+			return err
+		}
+		data.mutex.Lock()
+		data.cosmetics[change.Cosmetic] = cosmetic
+		data.mutex.Unlock()
+	case internal.CosmeticDeleted:
+		data.removeCosmetic(change.Cosmetic)
+	case internal.GrantAdded, internal.GrantRemoved, internal.PlayerDataUpdated, internal.PlayerDeleted:
+		player, err := ctx.Store.Player(ctx.Context, change.Player)
+		if errors.Is(err, internal.ErrNotFound) {
+			data.mutex.Lock()
+			delete(data.players, change.Player)
+			data.mutex.Unlock()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data.mutex.Lock()
+		data.players[player.Player] = player
+		data.mutex.Unlock()
+	}
+	return nil
+}
+
+// removeCosmetic also removes the cosmetic from every player, same as the cascade in the database
+func (data *dataset) removeCosmetic(id string) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	delete(data.cosmetics, id)
+	for key, player := range data.players {
+		if slices.Contains(player.Cosmetics, id) {
+			player.Cosmetics = slices.DeleteFunc(slices.Clone(player.Cosmetics), func(cosmetic string) bool {
+				return cosmetic == id
+			})
+			data.players[key] = player
+		}
+	}
+}
+
+func (data *dataset) entries() (Response, error) {
+	data.mutex.RLock()
+	defer data.mutex.RUnlock()
+	if !data.loaded {
+		return Response{}, errDatasetNotLoaded
+	}
+
+	result := Response{
+		Players:   make([]PlayerType, 0, len(data.players)),
+		Cosmetics: make([]interface{}, 0, len(data.cosmetics)),
+	}
+	for _, id := range utils.SortedKeys(data.cosmetics) {
+		result.Cosmetics = append(result.Cosmetics, data.cosmetics[id])
+	}
+	for _, id := range utils.SortedKeys(data.players) {
+		result.Players = append(result.Players, data.players[id])
+	}
+	return result, nil
+}
+
+func (data *dataset) player(id uuid.UUID) (PlayerType, bool, error) {
+	data.mutex.RLock()
+	defer data.mutex.RUnlock()
+	if !data.loaded {
+		return PlayerType{}, false, errDatasetNotLoaded
+	}
+	player, found := data.players[id.String()]
+	return player, found, nil
+}
+
+func (data *dataset) playersByIds(ids []uuid.UUID) ([]PlayerType, error) {
+	data.mutex.RLock()
+	defer data.mutex.RUnlock()
+	if !data.loaded {
+		return nil, errDatasetNotLoaded
+	}
+	players := make([]PlayerType, 0, len(ids))
+	for _, id := range ids {
+		if player, found := data.players[id.String()]; found {
+			players = append(players, player)
+		}
+	}
+	return players, nil
+}
+
+func (data *dataset) cosmeticsByIds(ids []string) ([]interface{}, error) {
+	data.mutex.RLock()
+	defer data.mutex.RUnlock()
+	if !data.loaded {
+		return nil, errDatasetNotLoaded
+	}
+	cosmetics := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if cosmetic, found := data.cosmetics[id]; found {
+			cosmetics = append(cosmetics, cosmetic)
+		}
+	}
+	return cosmetics, nil
+}
+
+func (data *dataset) playerIds() ([]string, error) {
+	data.mutex.RLock()
+	defer data.mutex.RUnlock()
+	if !data.loaded {
+		return nil, errDatasetNotLoaded
+	}
+	return utils.SortedKeys(data.players), nil
+}
+
+func (data *dataset) cosmeticIds() ([]string, error) {
+	data.mutex.RLock()
+	defer data.mutex.RUnlock()
+	if !data.loaded {
+		return nil, errDatasetNotLoaded
+	}
+	return utils.SortedKeys(data.cosmetics), nil
+}
+
+// writeFromMemory answers a single player lookup, notFound keeps the status the database backed endpoint uses
+func writeFromMemory(res http.ResponseWriter, req *http.Request, playerId string, notFound int, value func(PlayerType) interface{}) {
+	id, err := uuid.Parse(playerId)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	player, found, err := memory.player(id)
+	if err != nil {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !found {
+		res.WriteHeader(notFound)
+		return
+	}
+
+	data, err := json.Marshal(value(player))
+	if err != nil {
+		internalError(res, req, "Failed to encode player", err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	writeWithETag(res, req, utils.ETag(data), data)
+}
+
+func writeIds(res http.ResponseWriter, req *http.Request, ids func() ([]string, error)) {
+	list, err := ids()
+	if err != nil {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		internalError(res, req, "Failed to encode ids", err)
+		return
+	}
+	_, _ = res.Write(data)
+}
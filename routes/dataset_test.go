@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"context"
+	"cosmetics/internal"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// newMemoryTestContext serves the public reads from a freshly loaded dataset
+func newMemoryTestContext(t *testing.T) internal.RouteContext {
+	t.Helper()
+	memory = &dataset{}
+	ctx := newTestContext(t, func(config *internal.Config) {
+		config.InMemory = true
+	})
+	if err := ServeFromMemory(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func memoryPlayer(t *testing.T, id string) (PlayerType, bool) {
+	t.Helper()
+	player, found, err := memory.player(uuid.MustParse(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return player, found
+}
+
+func TestDatasetLoad(t *testing.T) {
+	ctx := newMemoryTestContext(t)
+	player, found := memoryPlayer(t, defaultPlayer)
+	if !found || !reflect.DeepEqual(player.Cosmetics, []string{"default"}) || player.Data["default"] != "data" {
+		t.Errorf("unexpected default player %+v", player)
+	}
+
+	entries, err := memory.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosmetics, players, err := ctx.Store.Entries(ctx.Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, Response{Players: players, Cosmetics: cosmetics}) {
+		t.Errorf("the dataset differs from the store: %+v", entries)
+	}
+}
+
+func TestDatasetApply(t *testing.T) {
+	ctx := newMemoryTestContext(t)
+	const other = "00000000-0000-0000-0000-000000000001"
+
+	// Written like another instance would, the dataset only learns about it through the change
+	steps := []struct {
+		name   string
+		write  func() error
+		change internal.Change
+		check  func() bool
+	}{
+		{"cosmetic updated", func() error {
+			version := 1
+			return ctx.Store.PutCosmetic(ctx.Context, internal.StoredCosmetic{Id: "hat", Version: &version, Data: json.RawMessage(`{"id": "hat"}`)})
+		}, internal.Change{Type: internal.CosmeticUpdated, Cosmetic: "hat"}, func() bool {
+			cosmetics, _ := memory.cosmeticsByIds([]string{"hat"})
+			return len(cosmetics) == 1
+		}},
+		{"grant added", func() error {
+			return ctx.Store.Grant(ctx.Context, defaultPlayer, "hat")
+		}, internal.Change{Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "hat"}, func() bool {
+			player, _ := memoryPlayer(t, defaultPlayer)
+			return reflect.DeepEqual(player.Cosmetics, []string{"default", "hat"})
+		}},
+		{"player created", func() error {
+			return ctx.Store.SetPlayerData(ctx.Context, other, json.RawMessage(`{"name": "other"}`))
+		}, internal.Change{Type: internal.PlayerDataUpdated, Player: other}, func() bool {
+			player, found := memoryPlayer(t, other)
+			return found && player.Data["name"] == "other"
+		}},
+		{"cosmetic deleted", func() error {
+			return ctx.Store.DeleteCosmetic(ctx.Context, "hat")
+		}, internal.Change{Type: internal.CosmeticDeleted, Cosmetic: "hat"}, func() bool {
+			player, _ := memoryPlayer(t, defaultPlayer)
+			cosmetics, _ := memory.cosmeticsByIds([]string{"hat"})
+			return len(cosmetics) == 0 && reflect.DeepEqual(player.Cosmetics, []string{"default"})
+		}},
+		{"player deleted", func() error {
+			return ctx.Store.DeletePlayer(ctx.Context, other)
+		}, internal.Change{Type: internal.PlayerDeleted, Player: other}, func() bool {
+			_, found := memoryPlayer(t, other)
+			return !found
+		}},
+		{"dataset imported", func() error {
+			_, err := ctx.Store.Import(ctx.Context, internal.Dataset{Players: []internal.StoredPlayer{{Id: other, Data: json.RawMessage(`{}`)}}}, false, false)
+			return err
+		}, internal.Change{Type: internal.DatasetImported}, func() bool {
+			_, found := memoryPlayer(t, other)
+			return found
+		}},
+	}
+	for _, step := range steps {
+		if err := step.write(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		internal.RecordChange(ctx, step.change)
+		if !step.check() {
+			t.Errorf("%s: the dataset wasn't updated", step.name)
+		}
+	}
+}
+
+func TestDatasetNotLoaded(t *testing.T) {
+	memory = &dataset{}
+	ctx := newTestContext(t, func(config *internal.Config) {
+		config.InMemory = true
+	})
+	tests := []struct {
+		name    string
+		handler func(internal.RouteContext, http.ResponseWriter, *http.Request)
+		values  map[string]string
+	}{
+		{"player", GetPlayerData, map[string]string{"uuid": defaultPlayer}},
+		{"player data", GetPlayerCustomData, map[string]string{"uuid": defaultPlayer}},
+		{"player ids", ListPlayerIds, nil},
+		{"cosmetic ids", ListCosmeticIds, nil},
+	}
+	for _, test := range tests {
+		res := serve(ctx, test.handler, httptest.NewRequest("GET", "/", nil), test.values)
+		if res.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected status 503 before the dataset is loaded, got %d", test.name, res.Code)
+		}
+	}
+	entriesCache = internal.NewCache[*entriesSnapshot]()
+	serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil)
+	if ctx.Health.Status().Degraded {
+		t.Error("a dataset that is still loading must not mark the database unavailable")
+	}
+}
+
+func TestDatasetWaitsForListener(t *testing.T) {
+	memory = &dataset{}
+	ctx := newTestContext(t, func(config *internal.Config) {
+		config.InMemory = true
+	})
+	// A listener that never connects, the dataset must not be loaded before it could miss a change
+	pool, err := pgxpool.New(context.Background(), "postgres://cosmetics@127.0.0.1:1/cosmetics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ctx.Changes = internal.NewChangeListener(pool)
+	canceled, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ctx.Context = canceled
+
+	if err := ServeFromMemory(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected loading to wait for the listener, got %v", err)
+	}
+	if _, err := memory.entries(); !errors.Is(err, errDatasetNotLoaded) {
+		t.Errorf("expected the dataset not to be loaded, got %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	eventKeepAlive    = 15 * time.Second
+	eventWriteTimeout = 10 * time.Second
+	// How often the change log is pruned down to the configured retention
+	changeLogPruneInterval = time.Minute
+	// How long an id may stay missing from the log before it's taken for a rolled back insert
+	eventGapTimeout = 5 * time.Second
+)
+
+// resyncEvent tells a client that the changes it missed can't be replayed, it has to reload everything it keeps.
+// The stream continues with the changes after the id of the event.
+const resyncEvent = "resync"
+
+// eventFilter restricts a stream to the given players and cosmetics, an empty set lets everything through
+type eventFilter struct {
+	players   map[string]bool
+	cosmetics map[string]bool
+}
+
+func newEventFilter(req *http.Request) (eventFilter, error) {
+	filter := eventFilter{make(map[string]bool), make(map[string]bool)}
+	for _, value := range splitQuery(req, "uuid") {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid uuid %q", value)
+		}
+		filter.players[id.String()] = true
+	}
+	for _, value := range splitQuery(req, "cosmetic") {
+		if !utils.IsValidResourceLocationNamespace(value) {
+			return filter, fmt.Errorf("invalid cosmetic id %q", value)
+		}
+		filter.cosmetics[value] = true
+	}
+	return filter, nil
+}
+
+// splitQuery supports both repeated and comma separated query parameters
+func splitQuery(req *http.Request, name string) []string {
+	var values []string
+	for _, element := range req.URL.Query()[name] {
+		for _, value := range strings.Split(element, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func (filter eventFilter) matches(change internal.Change) bool {
+	// An import may touch any player or cosmetic, so every client has to know about it
+	if change.Type == internal.DatasetImported {
+		return true
+	}
+	if len(filter.players) != 0 && !filter.players[change.Player] {
+		return false
+	}
+	if len(filter.cosmetics) != 0 && !filter.cosmetics[change.Cosmetic] {
+		return false
+	}
+	return true
+}
+
+// eventStream delivers every change once. Ids are handed out when a change is inserted, not when it commits,
+// so the notification of a change may overtake the one of an earlier change.
+type eventStream struct {
+	ctx        internal.RouteContext
+	res        http.ResponseWriter
+	controller *http.ResponseController
+	filter     eventFilter
+	// lastId is the latest change every change before was delivered for, sent holds the ids delivered after a gap
+	lastId   int64
+	sent     map[int64]bool
+	gapSince time.Time
+}
+
+func newEventStream(ctx internal.RouteContext, res http.ResponseWriter, filter eventFilter, lastId int64) *eventStream {
+	return &eventStream{
+		ctx:        ctx,
+		res:        res,
+		controller: http.NewResponseController(res),
+		filter:     filter,
+		lastId:     lastId,
+		sent:       make(map[int64]bool),
+	}
+}
+
+func (stream *eventStream) write(format string, args ...interface{}) error {
+	// The stream outlives the server write timeout, so every write gets its own deadline instead
+	err := stream.controller.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stream.res, format, args...)
+	if err != nil {
+		return err
+	}
+	return stream.controller.Flush()
+}
+
+// send delivers a change unless it was delivered before. A change after a gap fills the gap from the log first,
+// ids that are still missing belong to changes that didn't commit yet and are delivered once they are notified.
+func (stream *eventStream) send(change internal.Change) error {
+	if change.Id <= stream.lastId || stream.sent[change.Id] {
+		return nil
+	}
+	if change.Id > stream.lastId+1 {
+		return stream.fill(change.Id)
+	}
+	return stream.deliver(change)
+}
+
+// fill delivers the changes in the log up to the given id
+func (stream *eventStream) fill(id int64) error {
+	changes, err := stream.ctx.Store.ChangesSince(stream.ctx.Context, stream.lastId, int(id-stream.lastId))
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Id > id {
+			break
+		}
+		if stream.sent[change.Id] {
+			continue
+		}
+		if err := stream.deliver(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (stream *eventStream) deliver(change internal.Change) error {
+	stream.sent[change.Id] = true
+	for stream.sent[stream.lastId+1] {
+		delete(stream.sent, stream.lastId+1)
+		stream.lastId++
+	}
+	if len(stream.sent) == 0 {
+		stream.gapSince = time.Time{}
+	} else if stream.gapSince.IsZero() {
+		stream.gapSince = time.Now()
+	}
+	// Ids of filtered changes are skipped as well, resuming from them would only replay filtered changes again
+	if !stream.filter.matches(change) {
+		return nil
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	// The event id is where the client resumes from, so it never passes a gap, the id of the change itself is in the data
+	return stream.write("id: %d\nevent: %s\ndata: %s\n\n", stream.lastId, change.Type, data)
+}
+
+// skipGaps gives up on ids missing for longer than eventGapTimeout, their inserts were rolled back
+func (stream *eventStream) skipGaps() error {
+	if len(stream.sent) == 0 || time.Since(stream.gapSince) < eventGapTimeout {
+		return nil
+	}
+	latest := slices.Max(slices.Collect(maps.Keys(stream.sent)))
+	// One last look at the log, in case a notification got lost
+	if err := stream.fill(latest); err != nil {
+		return err
+	}
+	stream.lastId = max(stream.lastId, latest)
+	clear(stream.sent)
+	stream.gapSince = time.Time{}
+	return nil
+}
+
+// replay sends everything from the change log the client has not seen yet. If part of it was already pruned
+// or it's more than the replay limit, the client is told to resync instead.
+func (stream *eventStream) replay() error {
+	limit := stream.ctx.Config().Events.MaxReplay
+	oldest, err := stream.ctx.Store.OldestChangeId(stream.ctx.Context)
+	if err != nil {
+		return err
+	}
+	// One more than the limit tells whether there are more
+	changes, err := stream.ctx.Store.ChangesSince(stream.ctx.Context, stream.lastId, limit+1)
+	if err != nil {
+		return err
+	}
+	if oldest > stream.lastId+1 || len(changes) > limit {
+		return stream.resync()
+	}
+
+	for _, change := range changes {
+		if err := stream.send(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (stream *eventStream) resync() error {
+	latest, err := stream.ctx.Store.LatestChangeId(stream.ctx.Context)
+	if err != nil {
+		return err
+	}
+	stream.lastId = latest
+	clear(stream.sent)
+	stream.gapSince = time.Time{}
+	data, err := json.Marshal(internal.Change{Id: latest, Type: resyncEvent})
+	if err != nil {
+		return err
+	}
+	return stream.write("id: %d\nevent: %s\ndata: %s\n\n", latest, resyncEvent, data)
+}
+
+// PruneChangeLog keeps the change log at the configured retention until the context is done
+func PruneChangeLog(ctx internal.RouteContext) {
+	ticker := time.NewTicker(changeLogPruneInterval)
+	defer ticker.Stop()
+	for {
+		pruned, err := ctx.Store.PruneChanges(ctx.Context, ctx.Config().Events.Retention)
+		if err != nil && ctx.Context.Err() == nil {
+			utils.LogData{
+				Message: "Failed to prune change log",
+				Data:    err.Error(),
+				Level:   slog.LevelWarn,
+			}.Log()
+		}
+		if pruned > 0 {
+			utils.LogData{
+				Message: "Pruned change log",
+				Data:    pruned,
+				Level:   slog.LevelDebug,
+			}.Log()
+		}
+
+		select {
+		case <-ctx.Context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func lastEventId(req *http.Request) (int64, bool, error) {
+	value := req.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = req.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	return id, true, err
+}
+
+func StreamEvents(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	filter, err := newEventFilter(req)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, err.Error())
+		return
+	}
+	lastId, resume, err := lastEventId(req)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, "Invalid Last-Event-ID")
+		return
+	}
+
+	// Subscribe before reading the log, so nothing between the two gets lost, duplicates are dropped by id
+	changes := make(chan internal.Change, 64)
+	overflow := make(chan struct{}, 1)
+	resync := make(chan struct{}, 1)
+	removeChange := ctx.Changes.OnChange(func(change internal.Change) {
+		select {
+		case changes <- change:
+		default:
+			select {
+			case overflow <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer removeChange()
+	removeReconnect := ctx.Changes.OnReconnect(func() {
+		select {
+		case resync <- struct{}{}:
+		default:
+		}
+	})
+	defer removeReconnect()
+
+	if !resume {
+		lastId, err = ctx.Store.LatestChangeId(ctx.Context)
+		if err != nil {
+			utils.LogData{
+				Message: "Failed to read latest change",
+				Data:    err.Error(),
+				Level:   slog.LevelError,
+			}.LogContext(req.Context())
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stream := newEventStream(ctx, res, filter, lastId)
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	if stream.write("retry: %d\n\n", 5000) != nil {
+		return
+	}
+
+	if resume && stream.replay() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-overflow:
+			// The client is too slow to keep up, it resumes from its last event after reconnecting
+			return
+		case <-resync:
+			err = stream.replay()
+		case change := <-changes:
+			err = stream.send(change)
+		case <-keepAlive.C:
+			err = stream.skipGaps()
+			if err == nil {
+				err = stream.write(": keepalive\n\n")
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
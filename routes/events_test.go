@@ -0,0 +1,301 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"cosmetics/internal"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventFilter(t *testing.T) {
+	const other = "00000000-0000-0000-0000-000000000001"
+	grant := internal.Change{Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "default"}
+	tests := []struct {
+		query  string
+		change internal.Change
+		want   bool
+	}{
+		{"", grant, true},
+		{"uuid=" + defaultPlayer, grant, true},
+		{"uuid=" + strings.ToUpper(defaultPlayer), grant, true},
+		{"uuid=" + other, grant, false},
+		{"uuid=" + other + "," + defaultPlayer, grant, true},
+		{"uuid=" + other + "&uuid=" + defaultPlayer, grant, true},
+		{"cosmetic=default", grant, true},
+		{"cosmetic=hat", grant, false},
+		{"uuid=" + defaultPlayer + "&cosmetic=hat", grant, false},
+		{"cosmetic=default", internal.Change{Type: internal.PlayerDataUpdated, Player: defaultPlayer}, false},
+		{"uuid=" + other + "&cosmetic=hat", internal.Change{Type: internal.DatasetImported}, true},
+	}
+	for _, test := range tests {
+		filter, err := newEventFilter(httptest.NewRequest("GET", "/events?"+test.query, nil))
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		if got := filter.matches(test.change); got != test.want {
+			t.Errorf("%q matching %+v = %v, want %v", test.query, test.change, got, test.want)
+		}
+	}
+}
+
+func TestEventFilterInvalid(t *testing.T) {
+	for _, query := range []string{"uuid=not-a-uuid", "cosmetic=Not%20Valid"} {
+		if _, err := newEventFilter(httptest.NewRequest("GET", "/events?"+query, nil)); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+type event struct {
+	id   int64
+	name string
+	data internal.Change
+}
+
+// streamEvents connects to the event stream and reads the given number of events from it
+func streamEvents(t *testing.T, ctx internal.RouteContext, query string, lastEventId string, count int) []event {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		StreamEvents(ctx, res, req)
+	}))
+	defer server.Close()
+
+	requestContext, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(requestContext, "GET", server.URL+"/events?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	return readEvents(t, res.Body, count)
+}
+
+// readEvents reads events until it got the given number of them
+func readEvents(t *testing.T, body io.Reader, count int) []event {
+	t.Helper()
+	var events []event
+	var current event
+	scanner := bufio.NewScanner(body)
+	for len(events) < count && scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ": ")
+		switch field {
+		case "id":
+			current.id, _ = strconv.ParseInt(value, 10, 64)
+		case "event":
+			current.name = value
+		case "data":
+			if err := json.Unmarshal([]byte(value), &current.data); err != nil {
+				t.Fatal(err)
+			}
+		case "":
+			if current.name != "" {
+				events = append(events, current)
+			}
+			current = event{}
+		}
+	}
+	if len(events) < count {
+		t.Fatalf("expected %d events, got %v: %v", count, events, scanner.Err())
+	}
+	return events
+}
+
+func recordChanges(ctx internal.RouteContext, changes ...internal.Change) {
+	for _, change := range changes {
+		internal.RecordChange(ctx, change)
+	}
+}
+
+func TestStreamEventsReplay(t *testing.T) {
+	ctx := newTestContext(t)
+	recordChanges(ctx,
+		internal.Change{Type: internal.CosmeticUpdated, Cosmetic: "hat"},
+		internal.Change{Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "hat"},
+		internal.Change{Type: internal.CosmeticUpdated, Cosmetic: "cape"},
+		internal.Change{Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "cape"},
+	)
+
+	tests := []struct {
+		name        string
+		query       string
+		lastEventId string
+		want        []event
+	}{
+		{"everything", "", "0", []event{
+			{1, internal.CosmeticUpdated, internal.Change{Id: 1, Type: internal.CosmeticUpdated, Cosmetic: "hat"}},
+			{2, internal.GrantAdded, internal.Change{Id: 2, Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "hat"}},
+			{3, internal.CosmeticUpdated, internal.Change{Id: 3, Type: internal.CosmeticUpdated, Cosmetic: "cape"}},
+			{4, internal.GrantAdded, internal.Change{Id: 4, Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "cape"}},
+		}},
+		{"after the last seen", "", "2", []event{
+			{3, internal.CosmeticUpdated, internal.Change{Id: 3, Type: internal.CosmeticUpdated, Cosmetic: "cape"}},
+			{4, internal.GrantAdded, internal.Change{Id: 4, Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "cape"}},
+		}},
+		{"filtered", "cosmetic=cape&uuid=" + defaultPlayer, "0", []event{
+			{4, internal.GrantAdded, internal.Change{Id: 4, Type: internal.GrantAdded, Player: defaultPlayer, Cosmetic: "cape"}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := streamEvents(t, ctx, test.query, test.lastEventId, len(test.want))
+			if !reflect.DeepEqual(events, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, events)
+			}
+		})
+	}
+}
+
+func TestStreamEventsLive(t *testing.T) {
+	ctx := newTestContext(t)
+	recordChanges(ctx, internal.Change{Type: internal.CosmeticUpdated, Cosmetic: "hat"})
+
+	// Recorded until the stream received one, there is no telling when the stream subscribed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				recordChanges(ctx, internal.Change{Type: internal.CosmeticDeleted, Cosmetic: "hat"})
+			}
+		}
+	}()
+	events := streamEvents(t, ctx, "", "", 1)
+	if events[0].name != internal.CosmeticDeleted || events[0].id < 2 {
+		t.Errorf("expected only changes after connecting, got %+v", events)
+	}
+}
+
+func TestStreamEventsResync(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxReplay int
+		keep      int
+	}{
+		{"history pruned", 100, 2},
+		{"more than the replay limit", 2, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestContext(t, func(config *internal.Config) {
+				config.Events.MaxReplay = test.maxReplay
+			})
+			for range 5 {
+				recordChanges(ctx, internal.Change{Type: internal.CosmeticUpdated, Cosmetic: "hat"})
+			}
+			if _, err := ctx.Store.PruneChanges(ctx.Context, test.keep); err != nil {
+				t.Fatal(err)
+			}
+
+			events := streamEvents(t, ctx, "", "1", 1)
+			want := event{5, resyncEvent, internal.Change{Id: 5, Type: resyncEvent}}
+			if events[0] != want {
+				t.Errorf("expected %+v, got %+v", want, events[0])
+			}
+		})
+	}
+}
+
+// gapStore serves a fixed change log, which may have gaps like the one of Postgres
+type gapStore struct {
+	internal.Store
+	log []internal.Change
+}
+
+func (store gapStore) ChangesSince(_ context.Context, id int64, limit int) ([]internal.Change, error) {
+	var changes []internal.Change
+	for _, change := range store.log {
+		if change.Id > id && len(changes) < limit {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func TestEventStreamGaps(t *testing.T) {
+	changes := make([]internal.Change, 5)
+	for i := range changes {
+		changes[i] = internal.Change{Id: int64(i), Type: internal.CosmeticUpdated, Cosmetic: "hat"}
+	}
+	tests := []struct {
+		name     string
+		log      []internal.Change
+		notified []int
+		// Ids of the delivered changes and of the events they were sent with
+		want   [][2]int64
+		lastId int64
+	}{
+		{"in order", changes[1:4], []int{1, 2, 3}, [][2]int64{{1, 1}, {2, 2}, {3, 3}}, 3},
+		{"overtaken", changes[1:4], []int{3, 1, 2}, [][2]int64{{1, 1}, {2, 2}, {3, 3}}, 3},
+		{"committed late", []internal.Change{changes[1], changes[3]}, []int{3, 2}, [][2]int64{{1, 1}, {3, 1}, {2, 3}}, 3},
+		{"rolled back", []internal.Change{changes[1], changes[3]}, []int{3}, [][2]int64{{1, 1}, {3, 1}}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestContext(t)
+			ctx.Store = gapStore{ctx.Store, test.log}
+			var stream *eventStream
+			done := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				defer close(done)
+				stream = newEventStream(ctx, res, eventFilter{}, 0)
+				for _, id := range test.notified {
+					if err := stream.send(changes[id]); err != nil {
+						t.Error(err)
+					}
+				}
+			}))
+			defer server.Close()
+			res, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer res.Body.Close()
+
+			events := readEvents(t, res.Body, len(test.want))
+			<-done
+			for i, event := range events {
+				if got := [2]int64{event.data.Id, event.id}; got != test.want[i] {
+					t.Errorf("expected change and event id %v, got %v", test.want[i], got)
+				}
+			}
+			if stream.lastId != test.lastId {
+				t.Errorf("expected the stream to be complete up to %d, got %d", test.lastId, stream.lastId)
+			}
+
+			// Missing ids are given up on after a while, the stream continues after the latest delivered change
+			stream.gapSince = time.Now().Add(-eventGapTimeout)
+			if err := stream.skipGaps(); err != nil {
+				t.Fatal(err)
+			}
+			if stream.lastId != 3 || len(stream.sent) != 0 {
+				t.Errorf("expected the gaps to be skipped, got %d and %v", stream.lastId, stream.sent)
+			}
+		})
+	}
+}
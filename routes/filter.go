@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const playerFilterVersion = 1
+const playerFilterFalsePositiveRate = 0.01
+
+// playerFilterResponse is a bloom filter over every player that has a record,
+// see utils.BloomFilter for how clients have to check a uuid against it. The data is base64 encoded.
+type playerFilterResponse struct {
+	Version int    `json:"version"`
+	Players int    `json:"players"`
+	Bits    uint64 `json:"bits"`
+	Hashes  uint64 `json:"hashes"`
+	Data    []byte `json:"data"`
+}
+
+func buildPlayerFilter(players []PlayerType) (*encodedPayload, error) {
+	filter := utils.NewBloomFilter(len(players), playerFilterFalsePositiveRate)
+	for _, player := range players {
+		id, err := uuid.Parse(player.Player)
+		if err != nil {
+			continue
+		}
+		filter.Add(id)
+	}
+
+	data, err := json.Marshal(playerFilterResponse{
+		Version: playerFilterVersion,
+		Players: len(players),
+		Bits:    filter.Bits,
+		Hashes:  filter.Hashes,
+		Data:    filter.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newEncodedPayload(data)
+}
+
+func GetPlayerFilter(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	snapshot, created, ok := getEntriesSnapshotOrStale(ctx, res, req)
+	if !ok {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setSnapshotHeaders(ctx, res, created)
+	snapshot.filter.write(res, req)
+}
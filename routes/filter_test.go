@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"cosmetics/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestGetPlayerFilter(t *testing.T) {
+	ctx := newTestContext(t)
+	res := serve(ctx, GetPlayerFilter, httptest.NewRequest("GET", "/players/filter", nil), nil)
+	if res.Code != http.StatusOK || res.Header().Get("ETag") == "" {
+		t.Fatalf("expected 200 with an etag, got %d", res.Code)
+	}
+
+	var response playerFilterResponse
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Version != playerFilterVersion || response.Players != 1 {
+		t.Errorf("unexpected filter %+v", response)
+	}
+	filter := &utils.BloomFilter{Bits: response.Bits, Hashes: response.Hashes, Data: response.Data}
+	if !filter.Contains(uuid.MustParse(defaultPlayer)) {
+		t.Error("expected the filter to contain the default player")
+	}
+}
@@ -0,0 +1,158 @@
+package routes
+
+import (
+	"context"
+	"cosmetics/internal"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long a single readiness check may take, probes usually time out after a few seconds
+const readinessTimeout = 2 * time.Second
+
+const (
+	checkOk = "ok"
+	// The database is unreachable, but stale entries can still be served, so the instance stays in rotation
+	checkDegraded = "degraded"
+	checkFailing  = "failing"
+)
+
+type readinessCheck struct {
+	Status    string   `json:"status"`
+	Message   string   `json:"message,omitempty"`
+	LatencyMs *float64 `json:"latency_ms,omitempty"`
+	Version   *uint    `json:"version,omitempty"`
+	Expected  *uint    `json:"expected,omitempty"`
+	AgeSecs   *int     `json:"age_seconds,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready  bool                      `json:"ready"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+// GetLiveness only reports that the process is able to handle requests
+func GetLiveness(_ internal.RouteContext, res http.ResponseWriter, _ *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	_, _ = res.Write([]byte(`{"status":"ok"}`))
+}
+
+// GetReadiness checks everything needed to serve requests, it fails with a 503 if any check is failing
+func GetReadiness(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	checkContext, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+
+	cache := checkCache(ctx)
+	database := checkDatabase(ctx, checkContext, cache.Status != checkFailing)
+	migrations := checkMigrations(ctx, checkContext, database.Status != checkOk)
+	response := readinessResponse{Ready: true, Checks: map[string]readinessCheck{
+		"startup":    checkStartup(ctx),
+		"database":   database,
+		"migrations": migrations,
+		"cache":      cache,
+	}}
+	for _, check := range response.Checks {
+		if check.Status == checkFailing {
+			response.Ready = false
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		internalError(res, req, "Failed to encode readiness", err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	if !response.Ready {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = res.Write(data)
+}
+
+func checkStartup(ctx internal.RouteContext) readinessCheck {
+	status := ctx.Health.Status()
+	if !status.Ready {
+		return readinessCheck{Status: checkFailing, Message: status.Message}
+	}
+	return readinessCheck{Status: checkOk}
+}
+
+// checkDatabase fails if the database is slow or unreachable, unless stale entries can be served in the meantime
+func checkDatabase(ctx internal.RouteContext, checkContext context.Context, canServeStale bool) readinessCheck {
+	start := time.Now()
+	err := ctx.Store.Ping(checkContext)
+	latency := time.Since(start)
+	latencyMs := float64(latency.Microseconds()) / 1000
+	ctx.Health.Observe(err)
+
+	check := readinessCheck{Status: checkOk, LatencyMs: &latencyMs}
+	maxLatency := ctx.Config().Readiness.MaxPingLatencyDuration()
+	if err != nil {
+		check.Status = checkFailing
+		check.Message = err.Error()
+	} else if latency > maxLatency {
+		check.Status = checkFailing
+		check.Message = fmt.Sprintf("Ping took longer than %s", maxLatency)
+	}
+	if check.Status == checkFailing && canServeStale && ctx.Health.Status().Degraded {
+		check.Status = checkDegraded
+	}
+	return check
+}
+
+// checkMigrations fails while the database is behind this build or a migration failed halfway.
+// A database ahead of this build is fine, that's the case for the old instances during a rolling deployment.
+func checkMigrations(ctx internal.RouteContext, checkContext context.Context, databaseFailing bool) readinessCheck {
+	expected, err := internal.LatestMigration()
+	if err != nil {
+		return readinessCheck{Status: checkFailing, Message: err.Error()}
+	}
+	if databaseFailing {
+		return readinessCheck{Status: checkDegraded, Message: "Database unavailable", Expected: &expected}
+	}
+
+	version, dirty, err := ctx.Store.MigrationVersion(checkContext)
+	if err != nil {
+		return readinessCheck{Status: checkFailing, Message: err.Error(), Expected: &expected}
+	}
+	check := readinessCheck{Status: checkOk, Version: &version, Expected: &expected}
+	if dirty {
+		check.Status = checkFailing
+		check.Message = fmt.Sprintf("Migration %d is dirty", version)
+	} else if version < expected {
+		check.Status = checkFailing
+		check.Message = fmt.Sprintf("Database is at migration %d, expected %d", version, expected)
+	}
+	return check
+}
+
+// checkCache fails until the entries were built once, the build is started here as no traffic reaches an instance that isn't ready
+func checkCache(ctx internal.RouteContext) readinessCheck {
+	_, created, ok := entriesCache.Last()
+	status := checkOk
+	if !ok && ctx.Health.Ready() {
+		var err error
+		_, created, err = getEntriesSnapshot(ctx)
+		ok = err == nil
+		if !ok {
+			// Entries from the stale file still let the instance serve requests
+			_, created, ok = lastEntriesSnapshot(ctx)
+			status = checkDegraded
+		}
+	}
+	if !ok {
+		return readinessCheck{Status: checkFailing, Message: "Entries not built yet"}
+	}
+	age := int(time.Since(created) / time.Second)
+	return readinessCheck{Status: status, AgeSecs: &age}
+}
+
+// WarmEntries builds the entries, so the first requests don't have to wait for it
+func WarmEntries(ctx internal.RouteContext) error {
+	_, _, err := getEntriesSnapshot(ctx)
+	return err
+}
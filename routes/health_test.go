@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"context"
+	"cosmetics/internal"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// healthStore overrides the checks done by the readiness
+type healthStore struct {
+	internal.Store
+	ping     error
+	delay    time.Duration
+	version  uint
+	dirty    bool
+	behindBy uint
+}
+
+func (store healthStore) Ping(context.Context) error {
+	time.Sleep(store.delay)
+	return store.ping
+}
+
+func (store healthStore) MigrationVersion(ctx context.Context) (uint, bool, error) {
+	version, dirty, err := store.Store.MigrationVersion(ctx)
+	return version - store.behindBy, dirty || store.dirty, err
+}
+
+func TestGetLiveness(t *testing.T) {
+	ctx := newTestContext(t)
+	ctx.Health.SetStopping()
+	res := serve(ctx, GetLiveness, httptest.NewRequest("GET", "/healthz", nil), nil)
+	if res.Code != http.StatusOK || res.Body.String() != `{"status":"ok"}` {
+		t.Errorf("expected the liveness to pass while stopping, got %d %s", res.Code, res.Body.String())
+	}
+}
+
+func TestGetReadiness(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency int
+		prepare func(ctx *internal.RouteContext)
+		ready   bool
+		checks  map[string]string
+	}{
+		{"ready", 1000, func(*internal.RouteContext) {}, true,
+			map[string]string{"startup": checkOk, "database": checkOk, "migrations": checkOk, "cache": checkOk}},
+		{"starting", 1000, func(ctx *internal.RouteContext) {
+			ctx.Health = internal.NewHealth()
+		}, false, map[string]string{"startup": checkFailing, "cache": checkFailing}},
+		{"stopping", 1000, func(ctx *internal.RouteContext) {
+			ctx.Health.SetStopping()
+		}, false, map[string]string{"startup": checkFailing}},
+		{"slow database", 1, func(ctx *internal.RouteContext) {
+			ctx.Store = healthStore{Store: ctx.Store, delay: 10 * time.Millisecond}
+		}, false, map[string]string{"database": checkFailing}},
+		{"database down with entries", 1000, func(ctx *internal.RouteContext) {
+			_ = WarmEntries(*ctx)
+			ctx.Store = healthStore{Store: downStore{ctx.Store}, ping: errConnectionRefused}
+		}, true, map[string]string{"database": checkDegraded, "migrations": checkDegraded, "cache": checkOk}},
+		{"database down without entries", 1000, func(ctx *internal.RouteContext) {
+			ctx.Store = healthStore{Store: downStore{ctx.Store}, ping: errConnectionRefused}
+		}, false, map[string]string{"database": checkFailing, "cache": checkFailing}},
+		{"migration behind", 1000, func(ctx *internal.RouteContext) {
+			ctx.Store = healthStore{Store: ctx.Store, behindBy: 1}
+		}, false, map[string]string{"database": checkOk, "migrations": checkFailing}},
+		{"migration dirty", 1000, func(ctx *internal.RouteContext) {
+			ctx.Store = healthStore{Store: ctx.Store, dirty: true}
+		}, false, map[string]string{"migrations": checkFailing}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestContext(t, func(config *internal.Config) {
+				config.Readiness.MaxPingLatency = test.latency
+			})
+			// The last entries survive invalidation, each case starts before they were ever built
+			entriesCache = internal.NewCache[*entriesSnapshot]()
+			ctx.Health.SetReady()
+			test.prepare(&ctx)
+
+			res := serve(ctx, GetReadiness, httptest.NewRequest("GET", "/readyz", nil), nil)
+			var response readinessResponse
+			if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			status := http.StatusOK
+			if !test.ready {
+				status = http.StatusServiceUnavailable
+			}
+			if res.Code != status || response.Ready != test.ready {
+				t.Errorf("expected status %d, got %d: %s", status, res.Code, res.Body.String())
+			}
+			for name, want := range test.checks {
+				if check := response.Checks[name]; check.Status != want {
+					t.Errorf("expected %s to be %s, got %+v", name, want, check)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package routes
+
+import (
+	"context"
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/google/uuid"
+)
+
+// The live protocol lets a client subscribe to the players it can currently see.
+//
+// Client messages:
+//
+//	{"type": "subscribe", "players": ["<uuid>", ...]}
+//	{"type": "unsubscribe", "players": ["<uuid>", ...]}
+//
+// Server messages:
+//
+//	{"type": "players", "players": [<player>, ...], "cosmetics": [<cosmetic>, ...]}
+//	{"type": "removed", "players": ["<uuid>", ...], "cosmetics": ["<id>", ...]}
+//	{"type": "error", "error": "<message>"}
+//
+// A players message replaces the state of the contained players, the cosmetics are the definitions
+// referenced by them that were not sent on this connection before. Subscribing to a player without any
+// record answers with a removed message, afterward only changes to subscribed players are pushed.
+const (
+	liveSubscribe   = "subscribe"
+	liveUnsubscribe = "unsubscribe"
+	livePlayers     = "players"
+	liveRemoved     = "removed"
+	liveError       = "error"
+)
+
+const (
+	liveMaxSubscriptions = 1000
+	liveReadLimit        = 64 * 1024
+	liveWriteTimeout     = 10 * time.Second
+	livePingInterval     = 30 * time.Second
+)
+
+type liveRequest struct {
+	Type    string   `json:"type"`
+	Players []string `json:"players"`
+}
+
+type livePlayersMessage struct {
+	Type      string        `json:"type"`
+	Players   []PlayerType  `json:"players"`
+	Cosmetics []interface{} `json:"cosmetics"`
+}
+
+type liveRemovedMessage struct {
+	Type      string   `json:"type"`
+	Players   []string `json:"players,omitempty"`
+	Cosmetics []string `json:"cosmetics,omitempty"`
+}
+
+type liveErrorMessage struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+type liveSession struct {
+	ctx     internal.RouteContext
+	conn    *websocket.Conn
+	context context.Context
+
+	players   map[uuid.UUID]bool
+	cosmetics map[string]bool
+}
+
+func (session *liveSession) write(message interface{}) error {
+	ctx, cancel := context.WithTimeout(session.context, liveWriteTimeout)
+	defer cancel()
+	return wsjson.Write(ctx, session.conn, message)
+}
+
+// refresh sends the current state of the given players together with every cosmetic definition the client is missing
+func (session *liveSession) refresh(ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	players, err := queryPlayers(session.ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]bool)
+	var missingCosmetics []string
+	for _, player := range players {
+		found[player.Player] = true
+		for _, cosmetic := range player.Cosmetics {
+			if !session.cosmetics[cosmetic] && !slices.Contains(missingCosmetics, cosmetic) {
+				missingCosmetics = append(missingCosmetics, cosmetic)
+			}
+		}
+	}
+
+	var cosmetics = make([]interface{}, 0)
+	if len(missingCosmetics) != 0 {
+		cosmetics, err = queryCosmetics(session.ctx, missingCosmetics)
+		if err != nil {
+			return err
+		}
+		for _, cosmetic := range missingCosmetics {
+			session.cosmetics[cosmetic] = true
+		}
+	}
+
+	if len(players) != 0 {
+		err = session.write(livePlayersMessage{livePlayers, players, cosmetics})
+		if err != nil {
+			return err
+		}
+	}
+
+	var removed []string
+	for _, id := range ids {
+		if !found[id.String()] {
+			removed = append(removed, id.String())
+		}
+	}
+	if len(removed) != 0 {
+		return session.write(liveRemovedMessage{Type: liveRemoved, Players: removed})
+	}
+	return nil
+}
+
+func (session *liveSession) handleRequest(request liveRequest) error {
+	ids, err := parseUuids(request.Players)
+	if err != nil {
+		return session.write(liveErrorMessage{liveError, err.Error()})
+	}
+
+	switch request.Type {
+	case liveSubscribe:
+		var added []uuid.UUID
+		for _, id := range ids {
+			if !session.players[id] {
+				added = append(added, id)
+			}
+		}
+		if len(session.players)+len(added) > liveMaxSubscriptions {
+			return session.write(liveErrorMessage{liveError, fmt.Sprintf("At most %d players can be subscribed", liveMaxSubscriptions)})
+		}
+		for _, id := range added {
+			session.players[id] = true
+		}
+		return session.refresh(added)
+	case liveUnsubscribe:
+		for _, id := range ids {
+			delete(session.players, id)
+		}
+		return nil
+	default:
+		return session.write(liveErrorMessage{liveError, fmt.Sprintf("Unknown message type %q", request.Type)})
+	}
+}
+
+func (session *liveSession) handleChange(change internal.Change) error {
+	switch change.Type {
+	case internal.GrantAdded, internal.GrantRemoved, internal.PlayerDataUpdated, internal.PlayerDeleted:
+		id, err := uuid.Parse(change.Player)
+		if err != nil || !session.players[id] {
+			return nil
+		}
+		return session.refresh([]uuid.UUID{id})
+	case internal.CosmeticUpdated:
+		if !session.cosmetics[change.Cosmetic] {
+			return nil
+		}
+		cosmetics, err := queryCosmetics(session.ctx, []string{change.Cosmetic})
+		if err != nil || len(cosmetics) == 0 {
+			return err
+		}
+		return session.write(livePlayersMessage{livePlayers, make([]PlayerType, 0), cosmetics})
+	case internal.CosmeticDeleted:
+		// Deleting a cosmetic also removes it from every player, so clients drop it from their players themselves
+		if !session.cosmetics[change.Cosmetic] {
+			return nil
+		}
+		delete(session.cosmetics, change.Cosmetic)
+		return session.write(liveRemovedMessage{Type: liveRemoved, Cosmetics: []string{change.Cosmetic}})
+	case internal.DatasetImported:
+		return session.resync()
+	}
+	return nil
+}
+
+// resync sends everything again after changes might have been missed
+func (session *liveSession) resync() error {
+	session.cosmetics = make(map[string]bool)
+	ids := make([]uuid.UUID, 0, len(session.players))
+	for id := range session.players {
+		ids = append(ids, id)
+	}
+	return session.refresh(ids)
+}
+
+func SubscribePlayers(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	// The connection is hijacked with the server timeouts still set on it, writes are bounded by liveWriteTimeout instead
+	controller := http.NewResponseController(res)
+	_ = controller.SetReadDeadline(time.Time{})
+	_ = controller.SetWriteDeadline(time.Time{})
+
+	conn, err := websocket.Accept(res, req, nil)
+	if err != nil {
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.CloseNow()
+	conn.SetReadLimit(liveReadLimit)
+
+	// The request context of a hijacked connection is only canceled once the server shuts down, which is handled
+	// separately, so the connection is closed with a proper status instead of being dropped by the pending read
+	connContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Same as with the event stream, a client that can't keep up is disconnected and has to subscribe again
+	changes := make(chan internal.Change, 64)
+	overflow := make(chan struct{}, 1)
+	resync := make(chan struct{}, 1)
+	removeChange := ctx.Changes.OnChange(func(change internal.Change) {
+		select {
+		case changes <- change:
+		default:
+			select {
+			case overflow <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer removeChange()
+	removeReconnect := ctx.Changes.OnReconnect(func() {
+		select {
+		case resync <- struct{}{}:
+		default:
+		}
+	})
+	defer removeReconnect()
+
+	requests := make(chan liveRequest)
+	go func() {
+		defer cancel()
+		for {
+			var request liveRequest
+			err := wsjson.Read(connContext, conn, &request)
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- request:
+			case <-connContext.Done():
+				return
+			}
+		}
+	}()
+
+	session := &liveSession{ctx, conn, connContext, make(map[uuid.UUID]bool), make(map[string]bool)}
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-connContext.Done():
+			return
+		case <-req.Context().Done():
+			_ = conn.Close(websocket.StatusGoingAway, "Server shutting down")
+			return
+		case <-overflow:
+			_ = conn.Close(websocket.StatusTryAgainLater, "Too many pending updates")
+			return
+		case request := <-requests:
+			err = session.handleRequest(request)
+		case change := <-changes:
+			err = session.handleChange(change)
+		case <-resync:
+			err = session.resync()
+		case <-ping.C:
+			pingContext, pingCancel := context.WithTimeout(connContext, liveWriteTimeout)
+			err = conn.Ping(pingContext)
+			pingCancel()
+		}
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				utils.LogData{
+					Message: "Closing live connection",
+					Data:    err.Error(),
+					Level:   slog.LevelWarn,
+				}.LogContext(req.Context())
+			}
+			_ = conn.Close(websocket.StatusInternalError, "")
+			return
+		}
+	}
+}
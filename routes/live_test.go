@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"context"
+	"cosmetics/internal"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// liveMessage holds any server message of the live protocol
+type liveMessage struct {
+	Type      string            `json:"type"`
+	Players   []json.RawMessage `json:"players"`
+	Cosmetics []json.RawMessage `json:"cosmetics"`
+	Error     string            `json:"error"`
+}
+
+func dialLive(t *testing.T, ctx internal.RouteContext) (*websocket.Conn, context.Context) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		SubscribePlayers(ctx, res, req)
+	}))
+	t.Cleanup(server.Close)
+
+	dialContext, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	conn, _, err := websocket.Dial(dialContext, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.CloseNow()
+	})
+	return conn, dialContext
+}
+
+func TestSubscribePlayers(t *testing.T) {
+	ctx := newTestContext(t)
+	conn, connContext := dialLive(t, ctx)
+	const unknown = "00000000-0000-0000-0000-000000000001"
+
+	steps := []struct {
+		name    string
+		request interface{}
+		change  *internal.Change
+		want    func(liveMessage) bool
+	}{
+		{"subscribe", liveRequest{liveSubscribe, []string{defaultPlayer}}, nil, func(message liveMessage) bool {
+			return message.Type == livePlayers && len(message.Players) == 1 && len(message.Cosmetics) == 1
+		}},
+		{"subscribe without record", liveRequest{liveSubscribe, []string{unknown}}, nil, func(message liveMessage) bool {
+			return message.Type == liveRemoved && string(message.Players[0]) == `"`+unknown+`"`
+		}},
+		{"invalid uuid", liveRequest{liveSubscribe, []string{"not-a-uuid"}}, nil, func(message liveMessage) bool {
+			return message.Type == liveError && strings.Contains(message.Error, "not-a-uuid")
+		}},
+		{"unknown type", liveRequest{"refresh", nil}, nil, func(message liveMessage) bool {
+			return message.Type == liveError
+		}},
+		{"change of a subscribed player", nil, &internal.Change{Type: internal.PlayerDataUpdated, Player: defaultPlayer}, func(message liveMessage) bool {
+			// The definition was sent before, so only the player is sent again
+			return message.Type == livePlayers && len(message.Players) == 1 && len(message.Cosmetics) == 0
+		}},
+		{"deleted cosmetic", nil, &internal.Change{Type: internal.CosmeticDeleted, Cosmetic: "default"}, func(message liveMessage) bool {
+			return message.Type == liveRemoved && string(message.Cosmetics[0]) == `"default"`
+		}},
+	}
+	for _, step := range steps {
+		if step.request != nil {
+			if err := wsjson.Write(connContext, conn, step.request); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if step.change != nil {
+			internal.RecordChange(ctx, *step.change)
+		}
+		var message liveMessage
+		if err := wsjson.Read(connContext, conn, &message); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !step.want(message) {
+			t.Errorf("%s: unexpected message %+v", step.name, message)
+		}
+	}
+}
+
+func TestSubscribePlayersUnsubscribed(t *testing.T) {
+	ctx := newTestContext(t)
+	conn, connContext := dialLive(t, ctx)
+	const other = "00000000-0000-0000-0000-000000000001"
+	if _, err := ctx.Store.CreatePlayer(ctx.Context, other); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []liveRequest{
+		{liveSubscribe, []string{defaultPlayer}},
+		{liveUnsubscribe, []string{defaultPlayer}},
+		{liveSubscribe, []string{other}},
+	}
+	for _, request := range requests {
+		if err := wsjson.Write(connContext, conn, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var message liveMessage
+	if err := wsjson.Read(connContext, conn, &message); err != nil || message.Type != livePlayers {
+		t.Fatalf("expected the subscribed player, got %+v, %v", message, err)
+	}
+	if err := wsjson.Read(connContext, conn, &message); err != nil || message.Type != livePlayers {
+		t.Fatalf("expected the second subscribed player, got %+v, %v", message, err)
+	}
+
+	// Only the change of the player that is still subscribed is pushed
+	internal.RecordChange(ctx, internal.Change{Type: internal.PlayerDataUpdated, Player: defaultPlayer})
+	internal.RecordChange(ctx, internal.Change{Type: internal.PlayerDataUpdated, Player: other})
+	if err := wsjson.Read(connContext, conn, &message); err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Players) != 1 || !strings.Contains(string(message.Players[0]), other) {
+		t.Errorf("expected only the subscribed player to be pushed, got %+v", message)
+	}
+}
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: internal.MetricsNamespace,
+		Name:      "entries_cache_hits_total",
+		Help:      "Entries requests answered from the cache.",
+	}, func() float64 {
+		return float64(entriesCache.Stats().Hits)
+	})
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: internal.MetricsNamespace,
+		Name:      "entries_cache_misses_total",
+		Help:      "Entries requests that had to wait for a rebuild.",
+	}, func() float64 {
+		return float64(entriesCache.Stats().Misses)
+	})
+	entriesRebuildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: internal.MetricsNamespace,
+		Name:      "entries_rebuild_duration_seconds",
+		Help:      "Time to read the dataset and build all entries payloads.",
+		Buckets:   prometheus.ExponentialBuckets(.005, 2, 12),
+	})
+	entriesPayloadBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: internal.MetricsNamespace,
+		Name:      "entries_payload_bytes",
+		Help:      "Size of the last built entries payload by format and encoding.",
+	}, []string{"format", "encoding"})
+	publishedChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: internal.MetricsNamespace,
+		Name:      "changes_total",
+		Help:      "Writes handled by this instance by change type, like grants, revokes and cosmetic updates.",
+	}, []string{"type"})
+)
+
+func observeEntriesPayloads(snapshot *entriesSnapshot) {
+	for format, payload := range map[string]*encodedPayload{"json": snapshot.entries, "binary": snapshot.binary} {
+		for encoding, variant := range payload.variants {
+			entriesPayloadBytes.WithLabelValues(format, encoding).Set(float64(len(variant.body)))
+		}
+	}
+}
+
+var metricsHandler = promhttp.Handler()
+
+func GetMetrics(_ internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	metricsHandler.ServeHTTP(res, req)
+}
@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetMetrics(t *testing.T) {
+	ctx := newTestContext(t)
+	serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil)
+	handler := internal.ObserveRequests(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	res := serve(ctx, GetMetrics, httptest.NewRequest("GET", "/metrics", nil), nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	metrics := res.Body.String()
+	for _, name := range []string{"entries_cache_misses_total", "entries_rebuild_duration_seconds", "entries_payload_bytes", "http_requests_total"} {
+		if !strings.Contains(metrics, "\n"+internal.MetricsNamespace+"_"+name) {
+			t.Errorf("expected %s in the namespace %s", name, internal.MetricsNamespace)
+		}
+	}
+}
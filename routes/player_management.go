@@ -3,24 +3,43 @@ package routes
 import (
 	"cosmetics/internal"
 	"cosmetics/utils"
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"slices"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
-const createPlayer = `
-	insert into players(id) values($1) on conflict do nothing;
-`
-
-const addPlayerCosmetic = `
-	insert into player_cosmetics (player_id, cosmetic_id)  values($1, $2) on conflict do nothing;
-`
+// GrantCosmetic gives a player a cosmetic and publishes the change, the player is created if it's new.
+// The api and the grant command both go through it.
+func GrantCosmetic(ctx internal.RouteContext, playerId string, cosmeticId string) error {
+	if !utils.IsValidResourceLocationNamespace(cosmeticId) {
+		return invalidRequest("Invalid cosmetic Id")
+	}
+	created, err := ctx.Store.CreatePlayer(ctx.Context, playerId)
+	if created {
+		publishChange(ctx, internal.Change{Type: internal.PlayerDataUpdated, Player: playerId})
+	}
+	if err == nil {
+		err = ctx.Store.Grant(ctx.Context, playerId, cosmeticId)
+	}
+	if err != nil {
+		return err
+	}
+	publishChange(ctx, internal.Change{Type: internal.GrantAdded, Player: playerId, Cosmetic: cosmeticId})
+	utils.LogData{
+		Message: "Added cosmetic to player!",
+		Data: struct {
+			Player   string
+			Cosmetic string
+		}{playerId, cosmeticId},
+	}.LogContext(ctx.Context)
+	return nil
+}
 
 func AddPlayerCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	playerId := req.PathValue("uuid")
@@ -31,70 +50,44 @@ func AddPlayerCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *
 			Player   string
 			Cosmetic string
 		}{playerId, cosmeticId},
-	}.Log()
-	if !utils.IsValidResourceLocationNamespace(cosmeticId) {
-		utils.LogData{
-			Message: "Failed to add cosmetic, invalid cosmetic id!",
-			Data: struct {
-				Player   string
-				Cosmetic string
-			}{playerId, cosmeticId},
-		}.Log()
-		res.WriteHeader(http.StatusBadRequest)
-		return
-	}
+		Level: slog.LevelDebug,
+	}.LogContext(req.Context())
 
-	_, _ = ctx.Pool.Exec(ctx.Context, createPlayer, playerId)
-	result, err := ctx.Pool.Exec(ctx.Context, addPlayerCosmetic, playerId, cosmeticId)
-	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			switch pgErr.Code {
-			case "23503":
-				res.WriteHeader(http.StatusBadRequest)
-				_, _ = io.WriteString(res, "No matching cosmetic found!")
-			case "23505":
-				res.WriteHeader(http.StatusBadRequest)
-			default:
-				utils.PrintData(result)
-				utils.PrintData(err)
-				res.WriteHeader(http.StatusInternalServerError)
-			}
-		} else {
-			utils.PrintData(result)
-			utils.PrintData(err)
-			res.WriteHeader(http.StatusInternalServerError)
-		}
-		utils.LogData{
-			Message: "Failed to add player cosmetic!",
-			Data:    err,
-		}.Log()
+	err := GrantCosmetic(ctx, playerId, cosmeticId)
+	if rejected(res, req, err) || unavailable(ctx, res, req, err) || err == nil {
 		return
 	}
-	if result.RowsAffected() != 1 {
+	switch {
+	case errors.Is(err, internal.ErrAlreadyGranted):
 		res.WriteHeader(http.StatusBadRequest)
 		_, _ = io.WriteString(res, "Already present!")
-		utils.LogData{
-			Message: "Failed to add cosmetic to player, no matching found!",
-			Data: struct {
-				Player   string
-				Cosmetic string
-			}{playerId, cosmeticId},
-		}.Log()
-		return
+	case errors.Is(err, internal.ErrUnknownCosmetic):
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, "No matching cosmetic found!")
+	case errors.Is(err, internal.ErrInvalid), errors.Is(err, internal.ErrNotFound):
+		res.WriteHeader(http.StatusBadRequest)
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
 	}
 	utils.LogData{
-		Message: "Added cosmetic to player!",
-		Data: struct {
-			Player   string
-			Cosmetic string
-		}{playerId, cosmeticId},
-	}.Log()
+		Message: "Failed to add player cosmetic!",
+		Data:    err,
+		Level:   slog.LevelWarn,
+	}.LogContext(req.Context())
 }
 
-const removePlayerCosmetic = `
-	delete from player_cosmetics where player_id = $1 and cosmetic_id = $2
-`
+// RevokeCosmetic takes a cosmetic from a player and publishes the change, the api and the revoke command both go through it
+func RevokeCosmetic(ctx internal.RouteContext, playerId string, cosmeticId string) error {
+	if !utils.IsValidResourceLocationNamespace(cosmeticId) {
+		return invalidRequest("Invalid cosmetic Id")
+	}
+	err := ctx.Store.Revoke(ctx.Context, playerId, cosmeticId)
+	if err != nil {
+		return err
+	}
+	publishChange(ctx, internal.Change{Type: internal.GrantRemoved, Player: playerId, Cosmetic: cosmeticId})
+	return nil
+}
 
 func RemovePlayerCosmetic(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	playerId := req.PathValue("uuid")
@@ -105,48 +98,34 @@ func RemovePlayerCosmetic(ctx internal.RouteContext, res http.ResponseWriter, re
 			Player   string
 			Cosmetic string
 		}{playerId, cosmeticId},
-	}.Log()
-	if !utils.IsValidResourceLocationNamespace(cosmeticId) {
-		utils.LogData{
-			Message: "Failed to remove cosmetic from player, invalid id!",
-			Data: struct {
-				Player   string
-				Cosmetic string
-			}{playerId, cosmeticId},
-		}.Log()
-		res.WriteHeader(http.StatusBadRequest)
+		Level: slog.LevelDebug,
+	}.LogContext(req.Context())
+
+	err := RevokeCosmetic(ctx, playerId, cosmeticId)
+	if rejected(res, req, err) || unavailable(ctx, res, req, err) || err == nil {
 		return
 	}
-
-	result, err := ctx.Pool.Exec(ctx.Context, removePlayerCosmetic, playerId, cosmeticId)
-	if err != nil {
-		utils.PrintData(result)
-		utils.PrintData(err)
+	if !errors.Is(err, internal.ErrNotFound) && !errors.Is(err, internal.ErrInvalid) {
 		utils.LogData{
 			Message: "Failed to remove cosmetic from player!",
 			Data:    err,
-		}.Log()
+			Level:   slog.LevelError,
+		}.LogContext(req.Context())
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if result.RowsAffected() != 1 {
-		utils.LogData{
-			Message: "Failed to remove cosmetic from player, no matching found!",
-			Data: struct {
-				Player   string
-				Cosmetic string
-			}{playerId, cosmeticId},
-		}.Log()
-		res.WriteHeader(http.StatusBadRequest)
-		_, _ = io.WriteString(res, "No matching pair found!")
-		return
-	}
+	utils.LogData{
+		Message: "Failed to remove cosmetic from player, no matching found!",
+		Data: struct {
+			Player   string
+			Cosmetic string
+		}{playerId, cosmeticId},
+		Level: slog.LevelWarn,
+	}.LogContext(req.Context())
+	res.WriteHeader(http.StatusBadRequest)
+	_, _ = io.WriteString(res, "No matching pair found!")
 }
 
-const setPlayerCustomData = `
-	insert into players (id, data) values ($1, $2) on conflict (id) do update set data = excluded.data;
-`
-
 func UpdatePlayerCustomData(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	playerId := req.PathValue("uuid")
 	body, err := io.ReadAll(req.Body)
@@ -160,9 +139,10 @@ func UpdatePlayerCustomData(ctx internal.RouteContext, res http.ResponseWriter,
 			Message: "Failed Updating player, invalid json!",
 			Data: struct {
 				Player string
-				Data   string
+				Body   string
 			}{playerId, string(body)},
-		}.Log()
+			Level: slog.LevelWarn,
+		}.LogContext(req.Context())
 		res.WriteHeader(http.StatusBadRequest)
 		_, _ = io.WriteString(res, "Invalid json!")
 		return
@@ -172,142 +152,252 @@ func UpdatePlayerCustomData(ctx internal.RouteContext, res http.ResponseWriter,
 		Message: "Update custom data for player",
 		Data: struct {
 			Player string
-			Data   string
+			Body   string
 		}{playerId, data},
-	}.Log()
+		Level: slog.LevelDebug,
+	}.LogContext(req.Context())
 
-	_, err = ctx.Pool.Exec(ctx.Context, setPlayerCustomData, playerId, data)
+	err = ctx.Store.SetPlayerData(ctx.Context, playerId, body)
+	if unavailable(ctx, res, req, err) {
+		return
+	}
+	if errors.Is(err, internal.ErrInvalid) {
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, err.Error())
+		return
+	}
 	if err != nil {
 		utils.LogData{
 			Message: "Failed to update custom player data",
 			Data: struct {
-				Error error
-				Data  string
-			}{err, data},
-		}.Log()
+				Error  error
+				Player string
+				Body   string
+			}{err, playerId, data},
+			Level: slog.LevelError,
+		}.LogContext(req.Context())
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	publishChange(ctx, internal.Change{Type: internal.PlayerDataUpdated, Player: playerId})
 }
 
-const getPlayerCustomData = `
-	select data from players where id = $1
-`
-
 func GetPlayerCustomData(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	playerId := req.PathValue("uuid")
-	result, err := ctx.Pool.Query(ctx.Context, getPlayerCustomData, playerId)
-	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+	if ctx.Config().InMemory {
+		writeFromMemory(res, req, playerId, http.StatusNotFound, func(player PlayerType) interface{} {
+			return player.Data
+		})
 		return
 	}
-	defer result.Close()
-	if !result.Next() {
+	data, err := ctx.Store.PlayerData(ctx.Context, playerId)
+	if errors.Is(err, internal.ErrInvalid) {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, internal.ErrNotFound) {
 		res.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	res.Header().Set("Content-Type", "application/json")
-	_, _ = res.Write(result.RawValues()[0])
+	writeWithETag(res, req, utils.ETag(data), data)
 }
 
-const deletePlayerQuery = `
-	delete from players where id = $1
-`
-
 func DeletePlayer(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	playerId := req.PathValue("uuid")
 
 	utils.LogData{
 		Message: "Trying to delete player",
 		Data:    playerId,
-	}.Log()
-	result, err := ctx.Pool.Exec(ctx.Context, deletePlayerQuery, playerId)
-	if err != nil {
+		Level:   slog.LevelDebug,
+	}.LogContext(req.Context())
+	err := ctx.Store.DeletePlayer(ctx.Context, playerId)
+	if unavailable(ctx, res, req, err) {
+		return
+	}
+	if errors.Is(err, internal.ErrInvalid) {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil && !errors.Is(err, internal.ErrNotFound) {
 		utils.LogData{
 			Message: "Failed to delete player!",
 			Data:    err,
-		}.Log()
+			Level:   slog.LevelError,
+		}.LogContext(req.Context())
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if result.RowsAffected() != 1 {
+	if err != nil {
 		utils.LogData{
 			Message: "Failed to delete player, no matching found!",
 			Data:    playerId,
-		}.Log()
+			Level:   slog.LevelWarn,
+		}.LogContext(req.Context())
 		res.WriteHeader(http.StatusNotFound)
+		return
 	}
+	publishChange(ctx, internal.Change{Type: internal.PlayerDeleted, Player: playerId})
 }
 
-const getPlayerQuery = `
-	select player_id, player_data, cosmetics from players_with_cosmetics where player_id = $1 limit 1
-`
-
 func GetPlayerData(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
 	playerId := req.PathValue("uuid")
-	result, err := ctx.Pool.Query(ctx.Context, getPlayerQuery, playerId)
-
-	if err != nil {
-		utils.PrintData(result)
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+	if ctx.Config().InMemory {
+		writeFromMemory(res, req, playerId, http.StatusBadRequest, func(player PlayerType) interface{} {
+			return player
+		})
+		return
+	}
+	player, err := ctx.Store.Player(ctx.Context, playerId)
+	ctx.Health.Observe(err)
+	if internal.IsUnavailable(err) && writeStale(ctx, res, req, http.StatusBadRequest, func(snapshot *entriesSnapshot) (interface{}, bool) {
+		id, err := uuid.Parse(playerId)
+		if err != nil {
+			return nil, false
+		}
+		player, found := snapshot.players[id.String()]
+		return player, found
+	}) {
 		return
 	}
 
-	defer result.Close()
-	player, err := pgx.CollectOneRow(result, pgx.RowToStructByPos[PlayerType])
+	if errors.Is(err, internal.ErrNotFound) || errors.Is(err, internal.ErrInvalid) {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			res.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		utils.PrintData(result)
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+		internalError(res, req, "Failed to get player", err)
 		return
 	}
 
 	data, err := json.Marshal(player)
 	if err != nil {
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+		internalError(res, req, "Failed to encode player", err)
 		return
 	}
 
-	_, _ = io.WriteString(res, string(data))
+	res.Header().Set("Content-Type", "application/json")
+	writeWithETag(res, req, utils.ETag(data), data)
+}
+
+// queryPlayers looks up all given players at once, players without any record are left out
+func queryPlayers(ctx internal.RouteContext, ids []uuid.UUID) ([]PlayerType, error) {
+	if ctx.Config().InMemory {
+		return memory.playersByIds(ids)
+	}
+	players := make([]string, 0, len(ids))
+	for _, id := range ids {
+		players = append(players, id.String())
+	}
+	return ctx.Store.PlayersByIds(ctx.Context, players)
+}
+
+// parseUuids validates all given uuids, returning the first invalid one as error
+func parseUuids(values []string) ([]uuid.UUID, error) {
+	ids := make([]uuid.UUID, 0, len(values))
+	for _, value := range values {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uuid %q", value)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
 }
 
-const getPlayerIds = `
-	select id from players
-`
+const maxBatchPlayers = 500
+
+// The body is read before the players can be counted, so it's limited to what the most players in their longest form take up
+const maxBatchBodySize = maxBatchPlayers*64 + 1024
+
+type batchRequest struct {
+	Players []string `json:"players"`
+}
 
-func ListPlayerIds(ctx internal.RouteContext, res http.ResponseWriter, _ *http.Request) {
-	var players, err = ctx.Pool.Query(ctx.Context, getPlayerIds)
+// GetPlayersBatch returns all requested players that have a record, with ?expand=cosmetics the definitions of their cosmetics are included
+func GetPlayersBatch(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	var request batchRequest
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxBatchBodySize)).Decode(&request)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = io.WriteString(res, fmt.Sprintf("At most %d players per batch", maxBatchPlayers))
+		return
+	}
 	if err != nil {
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, "Invalid json!")
+		return
+	}
+	if len(request.Players) > maxBatchPlayers {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = io.WriteString(res, fmt.Sprintf("At most %d players per batch", maxBatchPlayers))
+		return
+	}
+	ids, err := parseUuids(request.Players)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(res, err.Error())
 		return
 	}
-	defer players.Close()
 
-	var list = make([]string, 0)
-	for players.Next() {
-		id, err := uuid.FromBytes(players.RawValues()[0])
+	var result = Response{Players: make([]PlayerType, 0), Cosmetics: make([]interface{}, 0)}
+	if len(ids) != 0 {
+		result.Players, err = queryPlayers(ctx, ids)
 		if err != nil {
-			utils.LogData{
-				Message: "Failed to create uuid",
-				Data:    err,
-			}.Log()
-			continue
+			internalError(res, req, "Failed to query players", err)
+			return
+		}
+	}
+
+	if req.URL.Query().Get("expand") == "cosmetics" {
+		var cosmeticIds []string
+		for _, player := range result.Players {
+			for _, cosmetic := range player.Cosmetics {
+				if !slices.Contains(cosmeticIds, cosmetic) {
+					cosmeticIds = append(cosmeticIds, cosmetic)
+				}
+			}
+		}
+		if len(cosmeticIds) != 0 {
+			result.Cosmetics, err = queryCosmetics(ctx, cosmeticIds)
+			if err != nil {
+				internalError(res, req, "Failed to query cosmetics", err)
+				return
+			}
 		}
-		list = append(list, id.String())
+	}
+
+	format := negotiateFormat(res, req)
+	data, err := encodeResponse(format, result)
+	if err != nil {
+		internalError(res, req, "Failed to encode players", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", format)
+	_, _ = res.Write(data)
+}
+
+func ListPlayerIds(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	if ctx.Config().InMemory {
+		writeIds(res, req, memory.playerIds)
+		return
+	}
+	list, err := ctx.Store.PlayerIds(ctx.Context)
+	if err != nil {
+		internalError(res, req, "Failed to list players", err)
+		return
 	}
 
 	data, err := json.Marshal(list)
 	if err != nil {
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+		internalError(res, req, "Failed to encode player ids", err)
 		return
 	}
 
@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The player added by the 000002_default_data migration
+const defaultPlayer = "e90ea9ec-080a-401b-8d10-6a53c407ac53"
+
+// newTestContext runs the routes against a migrated memory store, so they start out with the entries of a fresh database
+func newTestContext(t *testing.T, configure ...func(*internal.Config)) internal.RouteContext {
+	t.Helper()
+	config := internal.Config{
+		Storage: internal.StorageMemory,
+		Cache:   internal.CacheConfig{Ttl: 5, MaxAge: 300},
+		Events:  internal.EventsConfig{Retention: 1000, MaxReplay: 100},
+	}
+	for _, configure := range configure {
+		configure(&config)
+	}
+	ctx, err := internal.NewRouteContext(config)
+	if err == nil {
+		err = ctx.Store.Migrate(ctx.Context)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cached entries are shared by the whole package
+	InvalidateEntries()
+	t.Cleanup(InvalidateEntries)
+	return ctx
+}
+
+// serve calls the handler with the given path values, like the mux would
+func serve(ctx internal.RouteContext, handler func(internal.RouteContext, http.ResponseWriter, *http.Request), req *http.Request, values map[string]string) *httptest.ResponseRecorder {
+	for key, value := range values {
+		req.SetPathValue(key, value)
+	}
+	res := httptest.NewRecorder()
+	handler(ctx, res, req)
+	return res
+}
+
+func TestGetPlayerData(t *testing.T) {
+	ctx := newTestContext(t)
+
+	tests := []struct {
+		name   string
+		player string
+		status int
+	}{
+		{"existing", defaultPlayer, http.StatusOK},
+		{"upper case", "E90EA9EC-080A-401B-8D10-6A53C407AC53", http.StatusOK},
+		{"unknown", "00000000-0000-0000-0000-000000000001", http.StatusBadRequest},
+		{"invalid", "not-a-uuid", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := serve(ctx, GetPlayerData, httptest.NewRequest("GET", "/players/"+test.player, nil), map[string]string{"uuid": test.player})
+			if res.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, res.Code)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("expected json content type, got %q", contentType)
+			}
+			var player PlayerType
+			if err := json.Unmarshal(res.Body.Bytes(), &player); err != nil {
+				t.Fatal(err)
+			}
+			if player.Player != defaultPlayer || len(player.Cosmetics) != 1 || player.Cosmetics[0] != "default" {
+				t.Errorf("unexpected player %+v", player)
+			}
+		})
+	}
+}
+
+func TestConditionalLookups(t *testing.T) {
+	ctx := newTestContext(t)
+
+	tests := []struct {
+		name    string
+		handler func(internal.RouteContext, http.ResponseWriter, *http.Request)
+		values  map[string]string
+	}{
+		{"player", GetPlayerData, map[string]string{"uuid": defaultPlayer}},
+		{"player data", GetPlayerCustomData, map[string]string{"uuid": defaultPlayer}},
+		{"cosmetic", GetCosmetic, map[string]string{"cosmetic_id": "default"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := serve(ctx, test.handler, httptest.NewRequest("GET", "/", nil), test.values)
+			etag := res.Header().Get("ETag")
+			if res.Code != http.StatusOK || etag == "" {
+				t.Fatalf("expected 200 with an etag, got %d with %q", res.Code, etag)
+			}
+			if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("expected json content type, got %q", contentType)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("If-None-Match", etag)
+			res = serve(ctx, test.handler, req, test.values)
+			if res.Code != http.StatusNotModified || res.Body.Len() != 0 {
+				t.Errorf("expected an empty 304, got %d with %d bytes", res.Code, res.Body.Len())
+			}
+
+			req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("If-None-Match", `"outdated"`)
+			res = serve(ctx, test.handler, req, test.values)
+			if res.Code != http.StatusOK || res.Body.Len() == 0 {
+				t.Errorf("expected the full body for an outdated etag, got %d", res.Code)
+			}
+		})
+	}
+}
+
+func TestGetPlayersBatch(t *testing.T) {
+	ctx := newTestContext(t)
+	const unknown = "00000000-0000-0000-0000-000000000001"
+	tooMany := make([]string, maxBatchPlayers+1)
+	for i := range tooMany {
+		tooMany[i] = unknown
+	}
+	tooManyBody, _ := json.Marshal(batchRequest{tooMany})
+
+	tests := []struct {
+		name      string
+		query     string
+		body      string
+		status    int
+		players   int
+		cosmetics int
+	}{
+		{"existing and unknown", "", `{"players": ["` + defaultPlayer + `", "` + unknown + `"]}`, http.StatusOK, 1, 0},
+		{"expanded cosmetics", "?expand=cosmetics", `{"players": ["` + defaultPlayer + `"]}`, http.StatusOK, 1, 1},
+		{"no players", "", `{"players": []}`, http.StatusOK, 0, 0},
+		{"invalid json", "", `{"players": [`, http.StatusBadRequest, 0, 0},
+		{"invalid uuid", "", `{"players": ["not-a-uuid"]}`, http.StatusBadRequest, 0, 0},
+		{"too many players", "", string(tooManyBody), http.StatusRequestEntityTooLarge, 0, 0},
+		{"body too large", "", `{"players": [], "padding": "` + strings.Repeat("x", maxBatchBodySize) + `"}`, http.StatusRequestEntityTooLarge, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/players/batch"+test.query, strings.NewReader(test.body))
+			res := serve(ctx, GetPlayersBatch, req, nil)
+			if res.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, res.Code, res.Body.String())
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var result Response
+			if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Players) != test.players || len(result.Cosmetics) != test.cosmetics {
+				t.Errorf("expected %d players and %d cosmetics, got %+v", test.players, test.cosmetics, result)
+			}
+		})
+	}
+}
+
+func TestGetPlayersBatchBinary(t *testing.T) {
+	ctx := newTestContext(t)
+	req := httptest.NewRequest("POST", "/players/batch", strings.NewReader(`{"players": ["`+defaultPlayer+`"]}`))
+	req.Header.Set("Accept", binaryContentType)
+	res := serve(ctx, GetPlayersBatch, req, nil)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != binaryContentType {
+		t.Fatalf("expected a binary response, got %d %q", res.Code, res.Header().Get("Content-Type"))
+	}
+	if result := decodeBinary(t, res.Body.Bytes()); len(result.Players) != 1 || result.Players[0].Player != defaultPlayer {
+		t.Errorf("unexpected players %+v", result.Players)
+	}
+}
+
+func TestGrantAndRevokeCosmetic(t *testing.T) {
+	ctx := newTestContext(t)
+	const newPlayer = "00000000-0000-0000-0000-000000000001"
+
+	tests := []struct {
+		name     string
+		write    func(internal.RouteContext, string, string) error
+		handler  func(internal.RouteContext, http.ResponseWriter, *http.Request)
+		player   string
+		cosmetic string
+		err      error
+		status   int
+		body     string
+	}{
+		{"grant", GrantCosmetic, AddPlayerCosmetic, newPlayer, "default", nil, http.StatusOK, ""},
+		{"grant twice", GrantCosmetic, AddPlayerCosmetic, newPlayer, "default", internal.ErrAlreadyGranted, http.StatusBadRequest, "Already present!"},
+		{"grant unknown cosmetic", GrantCosmetic, AddPlayerCosmetic, newPlayer, "unknown", internal.ErrUnknownCosmetic, http.StatusBadRequest, "No matching cosmetic found!"},
+		{"grant invalid cosmetic", GrantCosmetic, AddPlayerCosmetic, newPlayer, "Not Valid", invalidRequest("Invalid cosmetic Id"), http.StatusBadRequest, "Invalid cosmetic Id"},
+		{"revoke", RevokeCosmetic, RemovePlayerCosmetic, newPlayer, "default", nil, http.StatusOK, ""},
+		{"revoke twice", RevokeCosmetic, RemovePlayerCosmetic, newPlayer, "default", internal.ErrNotFound, http.StatusBadRequest, "No matching pair found!"},
+		{"revoke invalid cosmetic", RevokeCosmetic, RemovePlayerCosmetic, newPlayer, "Not Valid", invalidRequest("Invalid cosmetic Id"), http.StatusBadRequest, "Invalid cosmetic Id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.write(ctx, test.player, test.cosmetic)
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	// The handlers map the same errors, replayed on a fresh store
+	ctx = newTestContext(t)
+	for _, test := range tests {
+		t.Run(test.name+" handler", func(t *testing.T) {
+			res := serve(ctx, test.handler, httptest.NewRequest("POST", "/", nil), map[string]string{"uuid": test.player, "cosmetic_id": test.cosmetic})
+			if res.Code != test.status || res.Body.String() != test.body {
+				t.Errorf("expected %d %q, got %d %q", test.status, test.body, res.Code, res.Body.String())
+			}
+		})
+	}
+}
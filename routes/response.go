@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"cosmetics/utils"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// writeWithETag writes the given body with a strong etag, or only a 304 if the client already has it.
+func writeWithETag(res http.ResponseWriter, req *http.Request, etag string, body []byte) {
+	res.Header().Set("ETag", etag)
+	if utils.IsNotModified(req, etag) {
+		res.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = res.Write(body)
+}
+
+// internalError logs why a request failed and answers it with a 500
+func internalError(res http.ResponseWriter, req *http.Request, message string, err error) {
+	utils.LogData{
+		Message: message,
+		Data:    err,
+		Level:   slog.LevelError,
+	}.LogContext(req.Context())
+	res.WriteHeader(http.StatusInternalServerError)
+}
+
+type encodedVariant struct {
+	body []byte
+	etag string
+}
+
+// encodedPayload holds a response body together with its pre-compressed variants,
+// so compression only happens once per rebuild and not once per request.
+type encodedPayload struct {
+	variants map[string]encodedVariant
+}
+
+var payloadEncodings = []string{utils.EncodingZstd, utils.EncodingGzip}
+
+func newEncodedPayload(body []byte) (*encodedPayload, error) {
+	etag := utils.ETag(body)
+	payload := &encodedPayload{variants: map[string]encodedVariant{
+		utils.EncodingIdentity: {body, etag},
+	}}
+
+	for _, encoding := range payloadEncodings {
+		var compressed []byte
+		var err error
+		switch encoding {
+		case utils.EncodingGzip:
+			compressed, err = utils.Gzip(body)
+		case utils.EncodingZstd:
+			compressed, err = utils.Zstd(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Strong etags have to differ between encodings of the same resource
+		payload.variants[encoding] = encodedVariant{compressed, strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""}
+	}
+
+	return payload, nil
+}
+
+func (payload *encodedPayload) body() []byte {
+	return payload.variants[utils.EncodingIdentity].body
+}
+
+func (payload *encodedPayload) etag() string {
+	return payload.variants[utils.EncodingIdentity].etag
+}
+
+func (payload *encodedPayload) write(res http.ResponseWriter, req *http.Request) {
+	encoding := utils.NegotiateEncoding(req.Header.Get("Accept-Encoding"), payloadEncodings...)
+	variant := payload.variants[encoding]
+
+	res.Header().Add("Vary", "Accept-Encoding")
+	if encoding != utils.EncodingIdentity {
+		res.Header().Set("Content-Encoding", encoding)
+	}
+	writeWithETag(res, req, variant.etag, variant.body)
+}
@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"cosmetics/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodedPayload(t *testing.T) {
+	body := []byte(strings.Repeat(`{"cosmetics":[]}`, 50))
+	payload, err := newEncodedPayload(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"gzip", utils.EncodingGzip},
+		{"gzip, zstd", utils.EncodingZstd},
+		{"br", ""},
+	}
+	etags := make(map[string]bool)
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		res := httptest.NewRecorder()
+		payload.write(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%q: expected status 200, got %d", test.acceptEncoding, res.Code)
+		}
+		if encoding := res.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%q: expected encoding %q, got %q", test.acceptEncoding, test.encoding, encoding)
+		}
+		if vary := res.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("%q: expected to vary by Accept-Encoding, got %q", test.acceptEncoding, vary)
+		}
+		etags[res.Header().Get("ETag")] = true
+	}
+	if len(etags) != 3 {
+		t.Errorf("expected a distinct etag per encoding, got %v", etags)
+	}
+	if payload.etag() != utils.ETag(body) || !bytes.Equal(payload.body(), body) {
+		t.Error("the identity variant must be the body itself")
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(payload.variants[utils.EncodingGzip].body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decompressed, body) {
+		t.Errorf("gzip variant doesn't decompress to the body: %v", err)
+	}
+}
+
+func TestWriteWithETag(t *testing.T) {
+	body := []byte(`{}`)
+	etag := utils.ETag(body)
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+		body        string
+	}{
+		{"", http.StatusOK, "{}"},
+		{etag, http.StatusNotModified, ""},
+		{`W/` + etag, http.StatusNotModified, ""},
+		{`"other"`, http.StatusOK, "{}"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		res := httptest.NewRecorder()
+		writeWithETag(res, req, etag, body)
+		if res.Code != test.status || res.Body.String() != test.body {
+			t.Errorf("%q: expected %d %q, got %d %q", test.ifNoneMatch, test.status, test.body, res.Code, res.Body.String())
+		}
+		if res.Header().Get("ETag") != etag {
+			t.Errorf("%q: expected the etag on every response", test.ifNoneMatch)
+		}
+	}
+}
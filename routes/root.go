@@ -4,89 +4,181 @@ import (
 	"cosmetics/internal"
 	"cosmetics/utils"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
-
-	"github.com/jackc/pgx/v5"
 )
 
-const cosmeticRequest = `
-	select data from cosmetics
-`
-
-const playerRequest = `
-	select player_id as player, player_data as data, cosmetics FROM players_with_cosmetics
-`
-
-type PlayerType struct {
-	Player    string                 `json:"uuid"`
-	Data      map[string]interface{} `json:"extra_data"`
-	Cosmetics []string               `json:"cosmetics"`
-}
+type PlayerType = internal.Player
 
 type Response struct {
 	Players   []PlayerType  `json:"players"`
 	Cosmetics []interface{} `json:"cosmetics"`
 }
 
-var cache = ""
-var lastCreated time.Time
+// entriesSnapshot holds everything derived from one read of the whole dataset
+type entriesSnapshot struct {
+	entries *encodedPayload
+	binary  *encodedPayload
+	filter  *encodedPayload
+	shards  *shardSet
+
+	// Lookups for serving single players and cosmetics while the database is unavailable
+	players   map[string]PlayerType
+	cosmetics map[string]interface{}
+}
+
+var entriesCache = internal.NewCache[*entriesSnapshot]()
+
+func getEntriesSnapshot(ctx internal.RouteContext) (*entriesSnapshot, time.Time, error) {
+	return entriesCache.Get(ctx.Config().Cache.TtlDuration(), func() (*entriesSnapshot, error) {
+		start := time.Now()
+		result, err := fetchEntries(ctx)
+		// Entries served from memory don't touch the database, a dataset still loading says nothing about its health
+		if !ctx.Config().InMemory {
+			ctx.Health.Observe(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshot, err := newEntriesSnapshot(result)
+		if err != nil {
+			return nil, err
+		}
+		entriesRebuildDuration.Observe(time.Since(start).Seconds())
+		observeEntriesPayloads(snapshot)
+		writeStaleFile(ctx, snapshot)
+		return snapshot, nil
+	})
+}
 
-func GetEntries(ctx internal.RouteContext, res http.ResponseWriter, _ *http.Request) {
-	if len(cache) != 0 && time.Now().Sub(lastCreated) < time.Second*5 {
-		res.Header().Set("Content-Type", "application/json")
-		res.Header().Set("Cache-Control", "max-age=300")
-		res.Header().Set("Age", strconv.Itoa(int(time.Now().Sub(lastCreated)/time.Second)))
-		_, _ = io.WriteString(res, cache)
+func setSnapshotHeaders(ctx internal.RouteContext, res http.ResponseWriter, created time.Time) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ctx.Config().Cache.MaxAge))
+	res.Header().Set("Age", strconv.Itoa(int(time.Since(created)/time.Second)))
+}
+
+func GetEntries(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	snapshot, created, ok := getEntriesSnapshotOrStale(ctx, res, req)
+	if !ok {
+		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	cosmeticResult, err := ctx.Pool.Query(ctx.Context, cosmeticRequest)
-	if err != nil {
-		utils.PrintData(err)
-		utils.PrintData(cosmeticResult)
-		res.WriteHeader(http.StatusInternalServerError)
+	format := negotiateFormat(res, req)
+	setSnapshotHeaders(ctx, res, created)
+	if format == binaryContentType {
+		res.Header().Set("Content-Type", binaryContentType)
+		snapshot.binary.write(res, req)
 		return
 	}
-	defer cosmeticResult.Close()
+	snapshot.entries.write(res, req)
+}
 
-	playerResult, err := ctx.Pool.Query(ctx.Context, playerRequest)
+func fetchEntries(ctx internal.RouteContext) (Response, error) {
+	if ctx.Config().InMemory {
+		return memory.entries()
+	}
+
+	cosmetics, players, err := ctx.Store.Entries(ctx.Context)
+	return Response{Players: players, Cosmetics: cosmetics}, err
+}
+
+func newEntriesSnapshot(result Response) (*entriesSnapshot, error) {
+	data, err := json.Marshal(result)
 	if err != nil {
-		utils.PrintData(err)
-		utils.PrintData(playerResult)
-		res.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	entries, err := newEncodedPayload(data)
+	if err != nil {
+		return nil, err
 	}
-	defer playerResult.Close()
 
-	var result = Response{}
-	for cosmeticResult.Next() {
-		var cosmetic = make(map[string]interface{})
-		err := cosmeticResult.Scan(&cosmetic)
-		if err != nil {
-			continue
+	data, err = encodeBinary(result)
+	if err != nil {
+		return nil, err
+	}
+	binaryEntries, err := newEncodedPayload(data)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := buildPlayerFilter(result.Players)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := buildShards(result)
+	if err != nil {
+		return nil, err
+	}
+
+	players := make(map[string]PlayerType, len(result.Players))
+	for _, player := range result.Players {
+		players[player.Player] = player
+	}
+	cosmetics := make(map[string]interface{}, len(result.Cosmetics))
+	for _, cosmetic := range result.Cosmetics {
+		if definition, ok := cosmetic.(map[string]interface{}); ok {
+			if id, ok := definition["id"].(string); ok {
+				cosmetics[id] = definition
+			}
 		}
-		result.Cosmetics = append(result.Cosmetics, cosmetic)
 	}
-	if result.Cosmetics == nil {
-		result.Cosmetics = make([]interface{}, 0)
+
+	return &entriesSnapshot{entries, binaryEntries, filter, shards, players, cosmetics}, nil
+}
+
+// InvalidateEntries drops the cached entries, so the next request sees the latest data
+func InvalidateEntries() {
+	entriesCache.Invalidate()
+}
+
+// publishChange invalidates the local cache right away and lets the other replicas know about the change
+func publishChange(ctx internal.RouteContext, change internal.Change) {
+	publishedChanges.WithLabelValues(change.Type).Inc()
+	entriesCache.Invalidate()
+	if ctx.Config().InMemory {
+		// The notification reaches this instance as well, but applying right away keeps the write visible to the next read
+		memory.apply(ctx, change)
 	}
+	internal.RecordChange(ctx, change)
+}
 
-	list, err := pgx.CollectRows(playerResult, pgx.RowToStructByPos[PlayerType])
+// invalidRequest rejects a write before it reaches the store, the message is sent as the response body
+type invalidRequest string
 
-	result.Players = list
+func (err invalidRequest) Error() string {
+	return string(err)
+}
+
+// rejected answers a write refused by invalidRequest with a 400, it has to be checked before unavailable as it never reached the store
+func rejected(res http.ResponseWriter, req *http.Request, err error) bool {
+	var invalid invalidRequest
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	utils.LogData{
+		Message: "Rejected invalid write",
+		Data:    err,
+		Level:   slog.LevelWarn,
+	}.LogContext(req.Context())
+	res.WriteHeader(http.StatusBadRequest)
+	_, _ = io.WriteString(res, invalid.Error())
+	return true
+}
 
-	tempCache, err := json.Marshal(result)
+func GetCacheStats(_ internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(entriesCache.Stats())
 	if err != nil {
-		utils.PrintData(err)
-		res.WriteHeader(http.StatusInternalServerError)
+		internalError(res, req, "Failed to encode cache stats", err)
 		return
 	}
-	cache = string(tempCache)
-	lastCreated = time.Now()
+
 	res.Header().Set("Content-Type", "application/json")
-	res.Header().Set("Cache-Control", "max-age=300")
-	_, _ = io.WriteString(res, cache)
+	_, _ = res.Write(data)
 }
@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func readEntries(t *testing.T, res *httptest.ResponseRecorder) Response {
+	t.Helper()
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	var result Response
+	if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestEntriesInvalidatedByWrites(t *testing.T) {
+	ctx := newTestContext(t)
+	before := readEntries(t, serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil))
+
+	tests := []struct {
+		name    string
+		handler func(res *httptest.ResponseRecorder)
+		check   func(Response) bool
+	}{
+		{"cosmetic created", func(res *httptest.ResponseRecorder) {
+			req := httptest.NewRequest("POST", "/cosmetics/hat", strings.NewReader(`{"version": 1}`))
+			req.SetPathValue("cosmetic_id", "hat")
+			CreateOrUpdateCosmetic(ctx, res, req)
+		}, func(result Response) bool {
+			return len(result.Cosmetics) == len(before.Cosmetics)+1
+		}},
+		{"grant added", func(res *httptest.ResponseRecorder) {
+			req := httptest.NewRequest("POST", "/", nil)
+			req.SetPathValue("uuid", defaultPlayer)
+			req.SetPathValue("cosmetic_id", "hat")
+			AddPlayerCosmetic(ctx, res, req)
+		}, func(result Response) bool {
+			return len(result.Players) == 1 && len(result.Players[0].Cosmetics) == 2
+		}},
+		{"cosmetic deleted", func(res *httptest.ResponseRecorder) {
+			req := httptest.NewRequest("DELETE", "/", nil)
+			req.SetPathValue("cosmetic_id", "hat")
+			DeleteCosmetic(ctx, res, req)
+		}, func(result Response) bool {
+			return len(result.Cosmetics) == len(before.Cosmetics) && len(result.Players[0].Cosmetics) == 1
+		}},
+	}
+	for _, test := range tests {
+		res := httptest.NewRecorder()
+		test.handler(res)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", test.name, res.Code, res.Body.String())
+		}
+		after := readEntries(t, serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil))
+		if !test.check(after) {
+			t.Errorf("%s: the entries still show the old state: %+v", test.name, after)
+		}
+	}
+}
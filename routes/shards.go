@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Players are sharded by the first hex characters of their uuid, so 16^shardPrefixLength shards exist
+const shardPrefixLength = 2
+
+type shardResponse struct {
+	Players []PlayerType `json:"players"`
+}
+
+type cosmeticsShardResponse struct {
+	Cosmetics []interface{} `json:"cosmetics"`
+}
+
+// shardManifestResponse lists the etag of every shard, clients only have to refetch the shards whose etag changed
+type shardManifestResponse struct {
+	PrefixLength int               `json:"prefix_length"`
+	Cosmetics    string            `json:"cosmetics"`
+	Shards       map[string]string `json:"shards"`
+}
+
+type shardSet struct {
+	manifest  *encodedPayload
+	cosmetics *encodedPayload
+	shards    map[string]*encodedPayload
+}
+
+func shardPrefixes() []string {
+	count := 1 << (4 * shardPrefixLength)
+	prefixes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		prefixes = append(prefixes, fmt.Sprintf("%0*x", shardPrefixLength, i))
+	}
+	return prefixes
+}
+
+func buildShards(result Response) (*shardSet, error) {
+	players := make(map[string][]PlayerType)
+	for _, prefix := range shardPrefixes() {
+		players[prefix] = make([]PlayerType, 0)
+	}
+	for _, player := range result.Players {
+		if len(player.Player) < shardPrefixLength {
+			continue
+		}
+		prefix := strings.ToLower(player.Player[:shardPrefixLength])
+		players[prefix] = append(players[prefix], player)
+	}
+
+	set := &shardSet{shards: make(map[string]*encodedPayload)}
+	manifest := shardManifestResponse{
+		PrefixLength: shardPrefixLength,
+		Shards:       make(map[string]string),
+	}
+	for prefix, list := range players {
+		data, err := json.Marshal(shardResponse{list})
+		if err != nil {
+			return nil, err
+		}
+		shard, err := newEncodedPayload(data)
+		if err != nil {
+			return nil, err
+		}
+		set.shards[prefix] = shard
+		manifest.Shards[prefix] = shard.etag()
+	}
+
+	data, err := json.Marshal(cosmeticsShardResponse{result.Cosmetics})
+	if err != nil {
+		return nil, err
+	}
+	set.cosmetics, err = newEncodedPayload(data)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Cosmetics = set.cosmetics.etag()
+
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	set.manifest, err = newEncodedPayload(data)
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func writeShard(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request, choose func(*shardSet) *encodedPayload) {
+	snapshot, created, ok := getEntriesSnapshotOrStale(ctx, res, req)
+	if !ok {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	payload := choose(snapshot.shards)
+	if payload == nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	setSnapshotHeaders(ctx, res, created)
+	payload.write(res, req)
+}
+
+func GetShardManifest(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	writeShard(ctx, res, req, func(set *shardSet) *encodedPayload {
+		return set.manifest
+	})
+}
+
+func GetCosmeticsShard(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	writeShard(ctx, res, req, func(set *shardSet) *encodedPayload {
+		return set.cosmetics
+	})
+}
+
+func GetShard(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	prefix := strings.ToLower(req.PathValue("prefix"))
+	writeShard(ctx, res, req, func(set *shardSet) *encodedPayload {
+		return set.shards[prefix]
+	})
+}
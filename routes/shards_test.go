@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildShards(t *testing.T) {
+	players := []PlayerType{
+		{Player: "00000000-0000-0000-0000-000000000001", Cosmetics: []string{}},
+		{Player: "0f000000-0000-0000-0000-000000000001", Cosmetics: []string{}},
+		{Player: "FF000000-0000-0000-0000-000000000001", Cosmetics: []string{}},
+	}
+	before, err := buildShards(Response{Players: players, Cosmetics: []interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.shards) != 256 {
+		t.Fatalf("expected 256 shards, got %d", len(before.shards))
+	}
+
+	tests := []struct {
+		prefix  string
+		players int
+	}{
+		{"00", 1},
+		{"0f", 1},
+		{"ff", 1},
+		{"01", 0},
+	}
+	for _, test := range tests {
+		var shard shardResponse
+		if err := json.Unmarshal(before.shards[test.prefix].body(), &shard); err != nil {
+			t.Fatal(err)
+		}
+		if len(shard.Players) != test.players {
+			t.Errorf("expected %d players in shard %s, got %d", test.players, test.prefix, len(shard.Players))
+		}
+	}
+
+	var manifest shardManifestResponse
+	if err := json.Unmarshal(before.manifest.body(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for prefix, shard := range before.shards {
+		if manifest.Shards[prefix] != shard.etag() {
+			t.Errorf("the manifest lists a different etag for shard %s", prefix)
+		}
+	}
+	if manifest.PrefixLength != shardPrefixLength || manifest.Cosmetics != before.cosmetics.etag() {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	// Changing a player only changes the etag of its own shard
+	players[1].Cosmetics = []string{"hat"}
+	after, err := buildShards(Response{Players: players, Cosmetics: []interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for prefix, shard := range after.shards {
+		if changed := shard.etag() != before.shards[prefix].etag(); changed != (prefix == "0f") {
+			t.Errorf("shard %s changed: %v", prefix, changed)
+		}
+	}
+}
+
+func TestGetShard(t *testing.T) {
+	ctx := newTestContext(t)
+	tests := []struct {
+		prefix string
+		status int
+	}{
+		{"e9", http.StatusOK},
+		{"E9", http.StatusOK},
+		{"00", http.StatusOK},
+		{"e", http.StatusNotFound},
+		{"zz", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		res := serve(ctx, GetShard, httptest.NewRequest("GET", "/shards/"+test.prefix, nil), map[string]string{"prefix": test.prefix})
+		if res.Code != test.status {
+			t.Errorf("shard %s: expected status %d, got %d", test.prefix, test.status, res.Code)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A published snapshot consists of
+//
+//	entries.json      the same body as served by GetEntries
+//	entries.json.sig  the raw ed25519 signature of entries.json
+//	manifest.json     a snapshotManifest describing entries.json
+//	manifest.json.sig the raw ed25519 signature of manifest.json
+//
+// The manifest is signed as well, so clients can reject a mirror serving an outdated snapshot.
+// Every snapshot is written to its own directory below versions, the current symlink is swapped to it at once,
+// so a mirror never sees a file next to the signature of another snapshot. The previous snapshot is kept for
+// readers still downloading it.
+const (
+	snapshotEntriesFile  = "entries.json"
+	snapshotManifestFile = "manifest.json"
+	snapshotSignature    = ".sig"
+	snapshotCurrent      = "current"
+	snapshotVersions     = "versions"
+	snapshotsKept        = 2
+	snapshotVersion      = 1
+)
+
+type snapshotManifest struct {
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	File      string    `json:"file"`
+	Size      int       `json:"size"`
+	Sha256    string    `json:"sha256"`
+	ETag      string    `json:"etag"`
+	Signature []byte    `json:"signature"`
+	PublicKey []byte    `json:"public_key"`
+}
+
+type snapshotKeyResponse struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey []byte `json:"public_key"`
+}
+
+// writeAtomic makes sure readers of the file never pick up a half written one
+func writeAtomic(directory string, name string, data []byte) error {
+	file, err := os.CreateTemp(directory, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.Remove(file.Name())
+
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(directory, name))
+}
+
+func writeSigned(directory string, name string, data []byte, key ed25519.PrivateKey) ([]byte, error) {
+	signature := ed25519.Sign(key, data)
+	if err := os.WriteFile(filepath.Join(directory, name), data, 0644); err != nil {
+		return nil, err
+	}
+	return signature, os.WriteFile(filepath.Join(directory, name+snapshotSignature), signature, 0644)
+}
+
+func publishSnapshot(ctx internal.RouteContext, key ed25519.PrivateKey) error {
+	snapshot, created, err := getEntriesSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	directory := ctx.Config().Snapshots.Directory
+	versions := filepath.Join(directory, snapshotVersions)
+	if err = os.MkdirAll(versions, 0755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(versions, ".staging-*")
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(staging)
+
+	body := snapshot.entries.body()
+	signature, err := writeSigned(staging, snapshotEntriesFile, body, key)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(body)
+	manifest, err := json.Marshal(snapshotManifest{
+		Version:   snapshotVersion,
+		Created:   created.UTC(),
+		File:      snapshotEntriesFile,
+		Size:      len(body),
+		Sha256:    hex.EncodeToString(hash[:]),
+		ETag:      snapshot.entries.etag(),
+		Signature: signature,
+		PublicKey: key.Public().(ed25519.PublicKey),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = writeSigned(staging, snapshotManifestFile, manifest, key); err != nil {
+		return err
+	}
+	if err = os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+
+	// Names sort by time, which is what decides the snapshots that are kept
+	version := time.Now().UTC().Format("20060102T150405.000000000")
+	if err = os.Rename(staging, filepath.Join(versions, version)); err != nil {
+		return err
+	}
+	if err = swapSymlink(directory, snapshotCurrent, filepath.Join(snapshotVersions, version)); err != nil {
+		return err
+	}
+	return pruneSnapshots(versions)
+}
+
+// swapSymlink points the link to the target at once, by renaming a new link over it
+func swapSymlink(directory string, name string, target string) error {
+	temporary := filepath.Join(directory, "."+name+"-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.Symlink(target, temporary); err != nil {
+		return err
+	}
+	err := os.Rename(temporary, filepath.Join(directory, name))
+	if err != nil {
+		_ = os.Remove(temporary)
+	}
+	return err
+}
+
+// pruneSnapshots removes all but the latest snapshotsKept versions
+func pruneSnapshots(versions string) error {
+	entries, err := os.ReadDir(versions)
+	if err != nil {
+		return err
+	}
+	var published []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			published = append(published, entry.Name())
+		}
+	}
+	var errs []error
+	for _, version := range published[:max(len(published)-snapshotsKept, 0)] {
+		errs = append(errs, os.RemoveAll(filepath.Join(versions, version)))
+	}
+	return errors.Join(errs...)
+}
+
+// PublishSnapshots writes a signed snapshot to the configured directory on every interval until the context is done
+func PublishSnapshots(ctx internal.RouteContext) {
+	key, err := ctx.Config().Snapshots.PrivateKey()
+	if err != nil {
+		utils.LogData{
+			Message: "Not publishing snapshots",
+			Data:    err.Error(),
+			Level:   slog.LevelError,
+		}.Log()
+		return
+	}
+
+	ticker := time.NewTicker(ctx.Config().Snapshots.IntervalDuration())
+	defer ticker.Stop()
+	for {
+		err := publishSnapshot(ctx, key)
+		if err != nil {
+			utils.LogData{
+				Message: "Failed to publish snapshot",
+				Data:    err.Error(),
+				Level:   slog.LevelError,
+			}.Log()
+		}
+		select {
+		case <-ctx.Context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func GetSnapshotKey(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	if ctx.Config().Snapshots.SigningKey == "" {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key, err := ctx.Config().Snapshots.PrivateKey()
+	if err != nil {
+		internalError(res, req, "Failed to read signing key", err)
+		return
+	}
+
+	data, err := json.Marshal(snapshotKeyResponse{
+		Algorithm: "ed25519",
+		PublicKey: key.Public().(ed25519.PublicKey),
+	})
+	if err != nil {
+		internalError(res, req, "Failed to encode snapshot key", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	writeWithETag(res, req, utils.ETag(data), data)
+}
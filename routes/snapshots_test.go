@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"bytes"
+	"cosmetics/internal"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSigningKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	return base64.StdEncoding.EncodeToString(seed), ed25519.NewKeyFromSeed(seed)
+}
+
+// readSigned reads a published file and checks its detached signature
+func readSigned(t *testing.T, directory string, name string, key ed25519.PublicKey) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(directory, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := os.ReadFile(filepath.Join(directory, name+snapshotSignature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(key, data, signature) {
+		t.Fatalf("invalid signature of %s", name)
+	}
+	return data
+}
+
+func TestPublishSnapshot(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "snapshots")
+	encodedKey, key := testSigningKey(t)
+	ctx := newTestContext(t, func(config *internal.Config) {
+		config.Snapshots = internal.SnapshotConfig{Directory: directory, Interval: 60, SigningKey: encodedKey}
+	})
+	if err := publishSnapshot(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	public := key.Public().(ed25519.PublicKey)
+	current := filepath.Join(directory, snapshotCurrent)
+
+	entries := readSigned(t, current, snapshotEntriesFile, public)
+	res := serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil)
+	if !bytes.Equal(entries, res.Body.Bytes()) {
+		t.Error("the published entries differ from the served ones")
+	}
+
+	var manifest snapshotManifest
+	if err := json.Unmarshal(readSigned(t, current, snapshotManifestFile, public), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(entries)
+	if manifest.Version != snapshotVersion || manifest.File != snapshotEntriesFile || manifest.Size != len(entries) ||
+		manifest.Sha256 != hex.EncodeToString(hash[:]) || manifest.ETag != res.Header().Get("ETag") {
+		t.Errorf("the manifest doesn't describe the entries: %+v", manifest)
+	}
+	if !bytes.Equal(manifest.PublicKey, public) || !ed25519.Verify(public, entries, manifest.Signature) {
+		t.Error("the manifest must carry the key and signature of the entries")
+	}
+
+	// Publishing again swaps the current snapshot, only the previous one is kept and nothing temporary is left behind
+	for range 3 {
+		if err := publishSnapshot(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != snapshotCurrent || files[1].Name() != snapshotVersions {
+		t.Errorf("expected only the current link and the versions, got %v", files)
+	}
+	versions, err := os.ReadDir(filepath.Join(directory, snapshotVersions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != snapshotsKept {
+		t.Fatalf("expected %d kept snapshots, got %v", snapshotsKept, versions)
+	}
+	target, err := os.Readlink(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Join(snapshotVersions, versions[len(versions)-1].Name()) {
+		t.Errorf("expected the current link to point to the latest snapshot, got %s", target)
+	}
+	readSigned(t, current, snapshotEntriesFile, public)
+	readSigned(t, current, snapshotManifestFile, public)
+}
+
+func TestGetSnapshotKey(t *testing.T) {
+	encodedKey, key := testSigningKey(t)
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{"configured", encodedKey, http.StatusOK},
+		{"not configured", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		ctx := newTestContext(t, func(config *internal.Config) {
+			config.Snapshots.SigningKey = test.key
+		})
+		res := serve(ctx, GetSnapshotKey, httptest.NewRequest("GET", "/snapshots/key", nil), nil)
+		if res.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.name, test.status, res.Code)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response snapshotKeyResponse
+		if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Algorithm != "ed25519" || !bytes.Equal(response.PublicKey, key.Public().(ed25519.PublicKey)) {
+			t.Errorf("%s: unexpected key %+v", test.name, response)
+		}
+	}
+}
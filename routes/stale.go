@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"cosmetics/internal"
+	"cosmetics/utils"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// How long clients should wait before retrying a write while the database is unavailable
+const unavailableRetryAfter = 30 * time.Second
+
+// Failing to build the entries is logged at most once per interval, during an outage every request would log it otherwise.
+// Entering and leaving degraded mode is logged by the health.
+const entriesFailureLogInterval = time.Minute
+
+var lastEntriesFailureLog atomic.Int64
+
+func logEntriesFailure(req *http.Request, err error) {
+	now := time.Now().UnixNano()
+	last := lastEntriesFailureLog.Load()
+	if now-last < int64(entriesFailureLogInterval) || !lastEntriesFailureLog.CompareAndSwap(last, now) {
+		return
+	}
+	utils.LogData{
+		Message: "Failed to build entries",
+		Data:    err.Error(),
+		Level:   slog.LevelWarn,
+	}.LogContext(req.Context())
+}
+
+// getEntriesSnapshotOrStale falls back to the last known good entries if they can't be rebuilt right now
+func getEntriesSnapshotOrStale(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) (*entriesSnapshot, time.Time, bool) {
+	snapshot, created, err := getEntriesSnapshot(ctx)
+	if err == nil {
+		return snapshot, created, true
+	}
+	logEntriesFailure(req, err)
+
+	snapshot, created, ok := lastEntriesSnapshot(ctx)
+	if ok {
+		markStale(res)
+	}
+	return snapshot, created, ok
+}
+
+// lastEntriesSnapshot returns the last built entries, after a restart they are read from the stale file
+func lastEntriesSnapshot(ctx internal.RouteContext) (*entriesSnapshot, time.Time, bool) {
+	if snapshot, created, ok := entriesCache.Last(); ok {
+		return snapshot, created, true
+	}
+
+	snapshot, created, err := readStaleFile(ctx)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			utils.LogData{
+				Message: "Failed to read stale entries",
+				Data:    err.Error(),
+				Level:   slog.LevelError,
+			}.Log()
+		}
+		return nil, time.Time{}, false
+	}
+	entriesCache.Seed(snapshot, created)
+	return entriesCache.Last()
+}
+
+func markStale(res http.ResponseWriter) {
+	res.Header().Set("Warning", "110 - \"Response is Stale\"")
+}
+
+func writeStaleFile(ctx internal.RouteContext, snapshot *entriesSnapshot) {
+	file := ctx.Config().Cache.StaleFile
+	if file == "" {
+		return
+	}
+	err := writeAtomic(filepath.Dir(file), filepath.Base(file), snapshot.entries.body())
+	if err != nil {
+		utils.LogData{
+			Message: "Failed to write stale entries",
+			Data:    err.Error(),
+			Level:   slog.LevelError,
+		}.Log()
+	}
+}
+
+func readStaleFile(ctx internal.RouteContext) (*entriesSnapshot, time.Time, error) {
+	file := ctx.Config().Cache.StaleFile
+	if file == "" {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var result Response
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	snapshot, err := newEntriesSnapshot(result)
+	return snapshot, info.ModTime(), err
+}
+
+// unavailable records the result of a write and if the database was unreachable tells the client to retry later
+func unavailable(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request, err error) bool {
+	ctx.Health.Observe(err)
+	if !internal.IsUnavailable(err) {
+		return false
+	}
+	utils.LogData{
+		Message: "Rejecting write, database unavailable",
+		Data:    err.Error(),
+		Level:   slog.LevelWarn,
+	}.LogContext(req.Context())
+	res.Header().Set("Retry-After", strconv.Itoa(int(unavailableRetryAfter/time.Second)))
+	res.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
+
+// writeStale answers a lookup from the last known entries, returns false if there are none.
+// notFound keeps the status the database backed endpoint uses, so clients see the same status either way.
+func writeStale(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request, notFound int, lookup func(*entriesSnapshot) (interface{}, bool)) bool {
+	snapshot, _, ok := lastEntriesSnapshot(ctx)
+	if !ok {
+		return false
+	}
+	markStale(res)
+	value, found := lookup(snapshot)
+	if !found {
+		res.WriteHeader(notFound)
+		return true
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	res.Header().Set("Content-Type", "application/json")
+	writeWithETag(res, req, utils.ETag(data), data)
+	return true
+}
+
+// GetHealth reports startup progress and degraded mode, it only succeeds once startup finished
+func GetHealth(ctx internal.RouteContext, res http.ResponseWriter, req *http.Request) {
+	status := ctx.Health.Status()
+	data, err := json.Marshal(status)
+	if err != nil {
+		internalError(res, req, "Failed to encode health", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = res.Write(data)
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"context"
+	"cosmetics/internal"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errConnectionRefused = errors.New("dial tcp: connection refused")
+
+// downStore fails every operation like a database that can't be reached
+type downStore struct {
+	internal.Store
+}
+
+func (downStore) Entries(context.Context) ([]interface{}, []internal.Player, error) {
+	return nil, nil, errConnectionRefused
+}
+
+func (downStore) Player(context.Context, string) (internal.Player, error) {
+	return internal.Player{}, errConnectionRefused
+}
+
+func (downStore) Cosmetic(context.Context, string) (json.RawMessage, error) {
+	return nil, errConnectionRefused
+}
+
+func (downStore) PutCosmetic(context.Context, internal.StoredCosmetic) error {
+	return errConnectionRefused
+}
+
+func TestServeStale(t *testing.T) {
+	ctx := newTestContext(t)
+	const unknown = "00000000-0000-0000-0000-000000000001"
+	req := httptest.NewRequest("POST", "/cosmetics/hat", strings.NewReader(`{"version": 1}`))
+	if res := serve(ctx, CreateOrUpdateCosmetic, req, map[string]string{"cosmetic_id": "hat"}); res.Code != http.StatusOK {
+		t.Fatalf("failed to create cosmetic: %d", res.Code)
+	}
+	lookups := []struct {
+		name    string
+		handler func(internal.RouteContext, http.ResponseWriter, *http.Request)
+		values  map[string]string
+	}{
+		{"entries", GetEntries, nil},
+		{"player", GetPlayerData, map[string]string{"uuid": defaultPlayer}},
+		{"unknown player", GetPlayerData, map[string]string{"uuid": unknown}},
+		{"cosmetic", GetCosmetic, map[string]string{"cosmetic_id": "hat"}},
+		{"unknown cosmetic", GetCosmetic, map[string]string{"cosmetic_id": "cape"}},
+	}
+
+	// Clients must see the same status no matter if the database is reachable
+	live := make([]int, len(lookups))
+	for i, lookup := range lookups {
+		live[i] = serve(ctx, lookup.handler, httptest.NewRequest("GET", "/", nil), lookup.values).Code
+	}
+
+	InvalidateEntries()
+	ctx.Store = downStore{ctx.Store}
+	for i, lookup := range lookups {
+		res := serve(ctx, lookup.handler, httptest.NewRequest("GET", "/", nil), lookup.values)
+		if res.Code != live[i] {
+			t.Errorf("%s: expected status %d like while the database is reachable, got %d", lookup.name, live[i], res.Code)
+		}
+		if res.Header().Get("Warning") == "" {
+			t.Errorf("%s: expected the response to be marked as stale", lookup.name)
+		}
+	}
+	if !ctx.Health.Status().Degraded {
+		t.Error("expected the health to report degraded mode")
+	}
+
+	req = httptest.NewRequest("POST", "/cosmetics/hat", strings.NewReader(`{"version": 2}`))
+	res := serve(ctx, CreateOrUpdateCosmetic, req, map[string]string{"cosmetic_id": "hat"})
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") == "" {
+		t.Errorf("expected writes to be rejected with 503 and Retry-After, got %d", res.Code)
+	}
+}
+
+func TestServeStaleFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "entries.json")
+	configure := func(config *internal.Config) {
+		config.Cache.StaleFile = file
+	}
+	ctx := newTestContext(t, configure)
+	before := serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil)
+	if before.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", before.Code)
+	}
+
+	// A restarted instance has nothing in memory yet
+	entriesCache = internal.NewCache[*entriesSnapshot]()
+	ctx = newTestContext(t, configure)
+	ctx.Store = downStore{ctx.Store}
+	after := serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil)
+	if after.Code != http.StatusOK || after.Body.String() != before.Body.String() {
+		t.Errorf("expected the entries from the stale file, got %d", after.Code)
+	}
+}
+
+func TestServeStaleWithoutEntries(t *testing.T) {
+	entriesCache = internal.NewCache[*entriesSnapshot]()
+	ctx := newTestContext(t)
+	ctx.Store = downStore{ctx.Store}
+	res := serve(ctx, GetEntries, httptest.NewRequest("GET", "/", nil), nil)
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500 without any entries to fall back to, got %d", res.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// BloomFilter is a probabilistic set of uuids, it never misses a contained uuid but may report ones that were never added.
+//
+// The indices of a uuid are derived by double hashing its two big endian halves, the same way
+// java.util.UUID exposes them as most and least significant bits:
+//
+//	h1 = msb, h2 = lsb | 1
+//	index_i = (h1 + i * h2) mod bits, for i in [0, hashes)
+//
+// with all arithmetic on unsigned 64-bit integers. Bit n of the filter is bit n mod 8 (least significant first) of byte n / 8.
+type BloomFilter struct {
+	Bits   uint64
+	Hashes uint64
+	Data   []byte
+}
+
+// NewBloomFilter sizes a filter for the expected amount of entries and false positive rate
+func NewBloomFilter(entries int, falsePositiveRate float64) *BloomFilter {
+	count := math.Max(float64(entries), 1)
+	bits := math.Ceil(-count * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	bits = math.Max(math.Ceil(bits/8)*8, 64)
+	hashes := math.Max(math.Round(bits/count*math.Ln2), 1)
+
+	return &BloomFilter{
+		Bits:   uint64(bits),
+		Hashes: uint64(hashes),
+		Data:   make([]byte, uint64(bits)/8),
+	}
+}
+
+func (filter *BloomFilter) indices(id [16]byte, consumer func(index uint64) bool) {
+	h1 := binary.BigEndian.Uint64(id[:8])
+	h2 := binary.BigEndian.Uint64(id[8:]) | 1
+	for i := uint64(0); i < filter.Hashes; i++ {
+		if !consumer((h1 + i*h2) % filter.Bits) {
+			return
+		}
+	}
+}
+
+func (filter *BloomFilter) Add(id [16]byte) {
+	filter.indices(id, func(index uint64) bool {
+		filter.Data[index/8] |= 1 << (index % 8)
+		return true
+	})
+}
+
+func (filter *BloomFilter) Contains(id [16]byte) bool {
+	contained := true
+	filter.indices(id, func(index uint64) bool {
+		contained = filter.Data[index/8]&(1<<(index%8)) != 0
+		return contained
+	})
+	return contained
+}
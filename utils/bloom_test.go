@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestNewBloomFilter(t *testing.T) {
+	tests := []struct {
+		entries int
+		rate    float64
+		bits    uint64
+		hashes  uint64
+	}{
+		// Never smaller than 64 bits, even without entries
+		{0, 0.01, 64, 44},
+		{1000, 0.01, 9592, 7},
+		{1000, 0.001, 14384, 10},
+	}
+	for _, test := range tests {
+		filter := NewBloomFilter(test.entries, test.rate)
+		if filter.Bits != test.bits || filter.Hashes != test.hashes || uint64(len(filter.Data))*8 != filter.Bits {
+			t.Errorf("NewBloomFilter(%d, %v) = %d bits with %d hashes and %d bytes, want %d bits with %d hashes",
+				test.entries, test.rate, filter.Bits, filter.Hashes, len(filter.Data), test.bits, test.hashes)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	const entries = 1000
+	filter := NewBloomFilter(entries, 0.01)
+	added := make([]uuid.UUID, entries)
+	for i := range added {
+		added[i] = uuid.New()
+		filter.Add(added[i])
+	}
+	for _, id := range added {
+		if !filter.Contains(id) {
+			t.Fatalf("missing %s", id)
+		}
+	}
+
+	falsePositives := 0
+	for range 10000 {
+		if filter.Contains(uuid.New()) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("expected a false positive rate around 1%%, got %d of 10000", falsePositives)
+	}
+}
+
+// The bit layout is what clients implement, so it must never change
+func TestBloomFilterLayout(t *testing.T) {
+	filter := &BloomFilter{Bits: 64, Hashes: 2, Data: make([]byte, 8)}
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], 3)
+	binary.BigEndian.PutUint64(id[8:], 4)
+	filter.Add(id)
+
+	// h1 = 3, h2 = 4 | 1 = 5, so the bits 3 and 8 are set
+	want := []byte{1 << 3, 1, 0, 0, 0, 0, 0, 0}
+	if string(filter.Data) != string(want) {
+		t.Errorf("expected %08b, got %08b", want, filter.Data)
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompression(t *testing.T) {
+	data := []byte(strings.Repeat(`{"uuid":"e90ea9ec-080a-401b-8d10-6a53c407ac53","cosmetics":["default"]}`, 100))
+	tests := []struct {
+		name       string
+		compress   func([]byte) ([]byte, error)
+		decompress func([]byte) ([]byte, error)
+	}{
+		{EncodingGzip, Gzip, func(compressed []byte) ([]byte, error) {
+			reader, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(reader)
+		}},
+		{EncodingZstd, Zstd, func(compressed []byte) ([]byte, error) {
+			decoder, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer decoder.Close()
+			return decoder.DecodeAll(compressed, nil)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Twice, the second run reuses the pooled writers
+			for range 2 {
+				compressed, err := test.compress(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(compressed) >= len(data) {
+					t.Errorf("expected repetitive data to shrink, got %d of %d bytes", len(compressed), len(data))
+				}
+				decompressed, err := test.decompress(compressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decompressed, data) {
+					t.Fatal("decompressed data differs")
+				}
+			}
+		})
+	}
+}
@@ -1,20 +1,27 @@
 package utils
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"log/slog"
 )
 
+// LogData is a single log line, Data is logged as structured attributes with errors logged as their message
 type LogData struct {
 	Message string
 	Data    interface{}
+	// Defaults to info
+	Level slog.Level
 }
 
 func (data LogData) Log() {
-	PrintData(&data)
+	data.LogContext(context.Background())
 }
 
-func PrintData(data interface{}) {
-	g, _ := json.Marshal(data)
-	fmt.Println(string(g))
+// LogContext adds the request id and actor if the context belongs to a request
+func (data LogData) LogContext(ctx context.Context) {
+	if data.Data == nil {
+		slog.LogAttrs(ctx, data.Level, data.Message)
+		return
+	}
+	slog.LogAttrs(ctx, data.Level, data.Message, slog.Any("data", logValue(data.Data)))
 }
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// IsNotModified checks the If-None-Match header of the request against the given etag,
+// If-None-Match always uses the weak comparison so a W/ prefix is ignored.
+func IsNotModified(req *http.Request, etag string) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" || etag == "" {
+		return false
+	}
+
+	for _, element := range strings.Split(header, ",") {
+		element = strings.TrimSpace(element)
+		if element == "*" {
+			return true
+		}
+		if strings.TrimPrefix(element, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
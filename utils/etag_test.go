@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	etag := ETag([]byte("entries"))
+	if !strings.HasPrefix(etag, "\"") || !strings.HasSuffix(etag, "\"") || len(etag) != 34 {
+		t.Fatalf("expected a quoted 32 character hash, got %s", etag)
+	}
+	if ETag([]byte("entries")) != etag {
+		t.Error("the same data must have the same etag")
+	}
+	if ETag([]byte("other entries")) == etag {
+		t.Error("different data must have different etags")
+	}
+}
+
+func TestIsNotModified(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   bool
+	}{
+		{"no header", "", etag, false},
+		{"no etag", etag, "", false},
+		{"match", etag, etag, true},
+		{"mismatch", `"def"`, etag, false},
+		{"one of many", `"def", "abc"`, etag, true},
+		{"wildcard", "*", etag, true},
+		{"weak header", `W/"abc"`, etag, true},
+		{"weak etag", etag, `W/"abc"`, true},
+		{"unquoted", "abc", etag, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.header != "" {
+				req.Header.Set("If-None-Match", test.header)
+			}
+			if got := IsNotModified(req, test.etag); got != test.want {
+				t.Errorf("IsNotModified(%q, %q) = %v, want %v", test.header, test.etag, got, test.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"encoding/json"
+	"maps"
+	"slices"
 	"strings"
 )
 
@@ -15,3 +17,10 @@ func IsJson(str string) bool {
 	var rawMessage json.RawMessage
 	return json.Unmarshal([]byte(str), &rawMessage) == nil
 }
+
+// SortedKeys never returns nil, so empty lists are encoded as [] like the ones read from the database
+func SortedKeys[T any](values map[string]T) []string {
+	keys := slices.AppendSeq(make([]string, 0, len(values)), maps.Keys(values))
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	LogFormatJson = "json"
+	LogFormatText = "text"
+)
+
+const redacted = "[redacted]"
+
+// Attributes that are never written to the log, compared case-insensitively
+var redactedKeys = []string{"authorization", "body", "extra_data", "player_data"}
+
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	slog.SetDefault(newLogger(os.Stdout, LogFormatJson))
+}
+
+// SetupLogging replaces the default logger, the format is either LogFormatJson or LogFormatText
+func SetupLogging(out io.Writer, format string, level slog.Level) {
+	logLevel.Set(level)
+	slog.SetDefault(newLogger(out, format))
+}
+
+// SetLogLevel changes the level of the default logger while running
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+func newLogger(out io.Writer, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	if format == LogFormatText {
+		handler = slog.NewTextHandler(out, options)
+	} else {
+		handler = slog.NewJSONHandler(out, options)
+	}
+	return slog.New(requestHandler{handler})
+}
+
+func isRedacted(key string) bool {
+	return slices.Contains(redactedKeys, strings.ToLower(key))
+}
+
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	if isRedacted(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
+
+type requestKey struct{}
+
+// RequestInfo identifies the request a log line belongs to, the actor is only known once the route handled authentication
+type RequestInfo struct {
+	Id    string
+	mutex sync.Mutex
+	actor string
+}
+
+func (info *RequestInfo) SetActor(actor string) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	info.actor = actor
+}
+
+func (info *RequestInfo) Actor() string {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	return info.actor
+}
+
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestKey{}, info)
+}
+
+func GetRequestInfo(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// requestHandler adds the request id, actor and trace to every line logged with a request context
+type requestHandler struct {
+	slog.Handler
+}
+
+func (handler requestHandler) Handle(ctx context.Context, record slog.Record) error {
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	if info, ok := GetRequestInfo(ctx); ok {
+		record.AddAttrs(slog.String("request_id", info.Id))
+		if actor := info.Actor(); actor != "" {
+			record.AddAttrs(slog.String("actor", actor))
+		}
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler requestHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestHandler{handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler requestHandler) WithGroup(name string) slog.Handler {
+	return requestHandler{handler.Handler.WithGroup(name)}
+}
+
+var (
+	errorType    = reflect.TypeFor[error]()
+	stringerType = reflect.TypeFor[fmt.Stringer]()
+	timeType     = reflect.TypeFor[time.Time]()
+)
+
+// logValue turns structs and maps into groups, so nested fields can be redacted and errors keep their message
+func logValue(value interface{}) slog.Value {
+	switch value := value.(type) {
+	case nil:
+		return slog.AnyValue(nil)
+	case slog.Value:
+		return value
+	case slog.LogValuer:
+		return value.LogValue()
+	case error:
+		return slog.StringValue(value.Error())
+	case json.RawMessage:
+		return slog.StringValue(string(value))
+	}
+
+	reflected := reflect.ValueOf(value)
+	for reflected.Kind() == reflect.Pointer || reflected.Kind() == reflect.Interface {
+		if reflected.IsNil() {
+			return slog.AnyValue(nil)
+		}
+		reflected = reflected.Elem()
+	}
+	if reflected.Type() == timeType || reflected.Type().Implements(errorType) || reflected.Type().Implements(stringerType) {
+		return slog.AnyValue(reflected.Interface())
+	}
+
+	switch reflected.Kind() {
+	case reflect.Struct:
+		attrs := make([]slog.Attr, 0, reflected.NumField())
+		for i := range reflected.NumField() {
+			field := reflected.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			key := field.Name
+			if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == "-" {
+				continue
+			} else if tag != "" {
+				key = tag
+			}
+			attrs = append(attrs, groupAttr(key, reflected.Field(i).Interface()))
+		}
+		return slog.GroupValue(attrs...)
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {
+			break
+		}
+		keys := reflected.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(a.String(), b.String())
+		})
+		attrs := make([]slog.Attr, 0, len(keys))
+		for _, key := range keys {
+			attrs = append(attrs, groupAttr(key.String(), reflected.MapIndex(key).Interface()))
+		}
+		return slog.GroupValue(attrs...)
+	default:
+	}
+	return slog.AnyValue(reflected.Interface())
+}
+
+func groupAttr(key string, value interface{}) slog.Attr {
+	if isRedacted(key) {
+		return slog.String(key, redacted)
+	}
+	return slog.Attr{Key: key, Value: logValue(value)}
+}
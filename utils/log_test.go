@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger to a buffer until the test is done
+func captureLogs(t *testing.T, format string) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	SetupLogging(&out, format, slog.LevelInfo)
+	t.Cleanup(func() {
+		SetupLogging(os.Stdout, LogFormatJson, slog.LevelInfo)
+	})
+	return &out
+}
+
+func logLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		lines = append(lines, decoded)
+	}
+	return lines
+}
+
+func TestLogData(t *testing.T) {
+	type request struct {
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+		Ignored string            `json:"-"`
+	}
+	tests := []struct {
+		name string
+		data interface{}
+		want string
+	}{
+		{"string", "value", `"value"`},
+		{"error", errors.New("failed"), `"failed"`},
+		{"raw json", json.RawMessage(`{"a":1}`), `"{\"a\":1}"`},
+		{"redacted key", map[string]interface{}{"player_data": "secret", "player": "id"}, `{"player":"id","player_data":"[redacted]"}`},
+		{"nested struct", request{"POST", map[string]string{"Authorization": "token"}, "secret", "hidden"}, `{"method":"POST","headers":{"Authorization":"[redacted]"},"body":"[redacted]"}`},
+		{"nil pointer", (*request)(nil), `null`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := captureLogs(t, LogFormatJson)
+			LogData{Message: "test", Data: test.data}.Log()
+			line := logLines(t, out)[0]
+			data, _ := json.Marshal(line["data"])
+			var want interface{}
+			_ = json.Unmarshal([]byte(test.want), &want)
+			wanted, _ := json.Marshal(want)
+			if string(data) != string(wanted) {
+				t.Errorf("expected %s, got %s", wanted, data)
+			}
+		})
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{LogFormatJson, []string{`"msg":"test"`, `"level":"WARN"`, `"authorization":"[redacted]"`}},
+		{LogFormatText, []string{`msg=test`, `level=WARN`, `data.authorization=[redacted]`}},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			out := captureLogs(t, test.format)
+			LogData{Message: "test", Data: map[string]string{"authorization": "token"}, Level: slog.LevelWarn}.Log()
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("expected %s in %q", want, out.String())
+				}
+			}
+			if strings.Contains(out.String(), "token") {
+				t.Errorf("the token was logged: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	out := captureLogs(t, LogFormatJson)
+	LogData{Message: "hidden", Level: slog.LevelDebug}.Log()
+	SetLogLevel(slog.LevelDebug)
+	LogData{Message: "shown", Level: slog.LevelDebug}.Log()
+	if lines := logLines(t, out); len(lines) != 1 || lines[0]["msg"] != "shown" {
+		t.Errorf("expected only the line logged after changing the level, got %q", out.String())
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		keepId   bool
+		actor    string
+		status   int
+		logLevel string
+	}{
+		{"generated id", "", false, "", http.StatusOK, "INFO"},
+		{"forwarded id", "proxy-id.1", true, "admin", http.StatusCreated, "INFO"},
+		{"invalid id", "bad id\n", false, "", http.StatusOK, "INFO"},
+		{"server error", "", false, "", http.StatusInternalServerError, "WARN"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := captureLogs(t, LogFormatJson)
+			handler := LogRequests(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if test.actor != "" {
+					info, _ := GetRequestInfo(req.Context())
+					info.SetActor(test.actor)
+				}
+				LogData{Message: "handling"}.LogContext(req.Context())
+				res.WriteHeader(test.status)
+			}))
+			req := httptest.NewRequest("GET", "/players", nil)
+			if test.id != "" {
+				req.Header.Set(RequestIdHeader, test.id)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			id := res.Header().Get(RequestIdHeader)
+			if !isValidRequestId(id) || (id == test.id) != test.keepId {
+				t.Errorf("unexpected request id %q", id)
+			}
+			lines := logLines(t, out)
+			if len(lines) != 2 {
+				t.Fatalf("expected 2 lines, got %q", out.String())
+			}
+			for _, line := range lines {
+				if line["request_id"] != id {
+					t.Errorf("expected request id %q, got %v", id, line["request_id"])
+				}
+				if actor, _ := line["actor"].(string); actor != test.actor {
+					t.Errorf("expected actor %q, got %q", test.actor, actor)
+				}
+			}
+			done := lines[1]
+			if done["level"] != test.logLevel || done["data"].(map[string]interface{})["status"] != float64(test.status) {
+				t.Errorf("unexpected request line %v", done)
+			}
+		})
+	}
+}
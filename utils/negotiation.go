@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseQualities reads the weights of a comma separated accept style header, entries without a q parameter weigh 1
+func parseQualities(header string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, element := range strings.Split(header, ",") {
+		parts := strings.Split(element, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range parts[1:] {
+			value, found := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if !found {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				weight = 0
+				break
+			}
+			weight = parsed
+		}
+		weights[name] = weight
+	}
+	return weights
+}
+
+// NegotiateEncoding picks the best of the available encodings based on an Accept-Encoding header,
+// the order of available is used as preference if the client weighs multiple encodings the same.
+func NegotiateEncoding(header string, available ...string) string {
+	weights := parseQualities(header)
+
+	best := EncodingIdentity
+	bestWeight := 0.0
+	for _, encoding := range available {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best = encoding
+			bestWeight = weight
+		}
+	}
+	return best
+}
+
+// NegotiateContentType picks the best of the available media types based on an Accept header,
+// falling back to the first one if the client accepts none of them.
+func NegotiateContentType(header string, available ...string) string {
+	if strings.TrimSpace(header) == "" {
+		return available[0]
+	}
+	weights := parseQualities(header)
+
+	best := available[0]
+	bestWeight := 0.0
+	for _, contentType := range available {
+		mainType, _, _ := strings.Cut(contentType, "/")
+		weight, ok := weights[contentType]
+		if !ok {
+			weight, ok = weights[mainType+"/*"]
+		}
+		if !ok {
+			weight, ok = weights["*/*"]
+		}
+		if ok && weight > bestWeight {
+			best = contentType
+			bestWeight = weight
+		}
+	}
+	return best
+}
@@ -0,0 +1,50 @@
+package utils
+
+import "testing"
+
+func TestNegotiateEncoding(t *testing.T) {
+	available := []string{EncodingZstd, EncodingGzip}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", EncodingIdentity},
+		{"gzip", EncodingGzip},
+		{"gzip, zstd", EncodingZstd},
+		{"gzip;q=1, zstd;q=0.5", EncodingGzip},
+		{"GZIP", EncodingGzip},
+		{"*", EncodingZstd},
+		{"*;q=0.1, gzip;q=0", EncodingZstd},
+		{"zstd;q=0, gzip;q=0", EncodingIdentity},
+		{"gzip;q=invalid", EncodingIdentity},
+		{"br, deflate", EncodingIdentity},
+	}
+	for _, test := range tests {
+		if got := NegotiateEncoding(test.header, available...); got != test.want {
+			t.Errorf("NegotiateEncoding(%q) = %s, want %s", test.header, got, test.want)
+		}
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	const binary = "application/x-binary"
+	available := []string{"application/json", binary}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{binary, binary},
+		{"application/json, " + binary, "application/json"},
+		{"application/json;q=0.5, " + binary, binary},
+		{"application/*", "application/json"},
+		{"text/html", "application/json"},
+		{"text/html, " + binary + ";q=0.1", binary},
+	}
+	for _, test := range tests {
+		if got := NegotiateContentType(test.header, available...); got != test.want {
+			t.Errorf("NegotiateContentType(%q) = %s, want %s", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// Incoming request ids are only kept if they can't break the log format
+const maxRequestIdLength = 64
+
+// StatusRecorder remembers the status and size of a response, everything else goes through to the wrapped writer
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (recorder *StatusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *StatusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	written, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += written
+	return written, err
+}
+
+// Unwrap lets http.ResponseController reach flushing and deadlines of the wrapped writer
+func (recorder *StatusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+func (recorder *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, readWriter, err := http.NewResponseController(recorder.ResponseWriter).Hijack()
+	if err == nil {
+		recorder.status = http.StatusSwitchingProtocols
+	}
+	return conn, readWriter, err
+}
+
+func NewStatusRecorder(res http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: res}
+}
+
+// Status returns the written status, a handler that wrote nothing responded with 200
+func (recorder *StatusRecorder) Status() int {
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
+
+func (recorder *StatusRecorder) Bytes() int {
+	return recorder.bytes
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, char := range id {
+		valid := char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9' || char == '-' || char == '_' || char == '.'
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestId generates a random id for requests that arrive without one, and for commands acting outside of a request
+func NewRequestId() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// LogRequests gives every request an id, which is added to all lines logged with its context, and logs the request once it's done.
+// An id sent by a proxy in the X-Request-Id header is kept.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(RequestIdHeader)
+		if !isValidRequestId(id) {
+			id = NewRequestId()
+		}
+		info := &RequestInfo{Id: id}
+		req = req.WithContext(WithRequestInfo(req.Context(), info))
+		res.Header().Set(RequestIdHeader, id)
+
+		recorder := NewStatusRecorder(res)
+		next.ServeHTTP(recorder, req)
+
+		status := recorder.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		LogData{
+			Message: "Handled request",
+			Data: struct {
+				Method     string  `json:"method"`
+				Path       string  `json:"path"`
+				Route      string  `json:"route"`
+				Status     int     `json:"status"`
+				Bytes      int     `json:"bytes"`
+				DurationMs float64 `json:"duration_ms"`
+			}{req.Method, req.URL.Path, req.Pattern, status, recorder.Bytes(), float64(time.Since(start).Microseconds()) / 1000},
+			Level: level,
+		}.LogContext(req.Context())
+	})
+}